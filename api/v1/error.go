@@ -35,3 +35,253 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrOffsetNotFound is returned when reading an offset in the log's range whose record was compacted away
+type ErrOffsetNotFound struct {
+	Offset uint64
+}
+
+func (e ErrOffsetNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("offset not found: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record at offset %d was compacted away, a newer record with the same key replaced it",
+		e.Offset,
+	)
+	locMsgDetails := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(locMsgDetails)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOffsetNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrCorruptRecord is returned when the record stored at Offset doesn't match its checksum, e.g. because of a bad disk
+type ErrCorruptRecord struct {
+	Offset uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DataLoss,
+		fmt.Sprintf("corrupt record at offset: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record stored at offset %d failed its checksum and can't be served",
+		e.Offset,
+	)
+	locMsgDetails := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(locMsgDetails)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotLeader is returned by the servers that aren't the Raft leader for the calls only the leader can handle, e.g. Produce.
+// LeaderAddr is the RPC address of the leader to retry with, empty if there's no leader at the moment.
+type ErrNotLeader struct {
+	LeaderAddr string
+}
+
+// notLeaderReason identifies ErrNotLeader in the ErrorInfo details of its status
+const notLeaderReason = "NOT_LEADER"
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("not the leader, leader: %q", e.LeaderAddr),
+	)
+	msg := "This server isn't the leader, retry with the leader"
+	if e.LeaderAddr == "" {
+		msg = "There's no leader at the moment, retry once one is elected"
+	}
+	locMsgDetails := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	infoDetails := &errdetails.ErrorInfo{
+		Reason:   notLeaderReason,
+		Domain:   "proglog",
+		Metadata: map[string]string{"leader_addr": e.LeaderAddr},
+	}
+	std, err := st.WithDetails(locMsgDetails, infoDetails)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// NotLeader returns the ErrNotLeader a client got back from a server as err, and false if err isn't one
+func NotLeader(err error) (ErrNotLeader, bool) {
+	if e, ok := err.(ErrNotLeader); ok {
+		return e, true
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return ErrNotLeader{}, false
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Reason == notLeaderReason {
+			return ErrNotLeader{LeaderAddr: info.Metadata["leader_addr"]}, true
+		}
+	}
+	return ErrNotLeader{}, false
+}
+
+// ErrTopicNotFound is returned for the calls made on a topic that doesn't exist
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("topic not found: %q", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"There's no topic named %q, it has to be created first",
+		e.Topic,
+	)
+	locMsgDetails := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(locMsgDetails)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicExists is returned when creating a topic whose name is already taken
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("topic already exists: %q", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"There's a topic named %q already",
+		e.Topic,
+	)
+	locMsgDetails := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(locMsgDetails)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrPartitionNotFound is returned for the calls made on a partition the topic doesn't have
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("partition not found: %q/%d", e.Topic, e.Partition),
+	)
+	msg := fmt.Sprintf(
+		"The topic %q has no partition %d",
+		e.Topic, e.Partition,
+	)
+	locMsgDetails := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(locMsgDetails)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOutOfOrderSequence is returned for the records of an idempotent producer that don't follow the last ones the partition got from it,
+// either because records were lost in between or because they're retries of older ones than the partition remembers
+type ErrOutOfOrderSequence struct {
+	ProducerID uint64
+	Expected   uint64
+	Sequence   uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("out of order sequence: %d, expected: %d", e.Sequence, e.Expected),
+	)
+	msg := fmt.Sprintf(
+		"The partition expected sequence %d from producer %d, got %d",
+		e.Expected, e.ProducerID, e.Sequence,
+	)
+	locMsgDetails := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(locMsgDetails)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// maxTopicLen leaves room for the topics' names in file names
+const maxTopicLen = 249
+
+// ValidateTopic returns an InvalidArgument error unless the name is made of up to 249 letters, digits, '.', '_' and '-'.
+// It can't be "." or "..", since every topic gets a directory of its own.
+func ValidateTopic(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > maxTopicLen {
+		return status.Errorf(codes.InvalidArgument, "invalid topic name: %q", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return status.Errorf(codes.InvalidArgument, "invalid topic name: %q", name)
+		}
+	}
+	return nil
+}
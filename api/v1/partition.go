@@ -0,0 +1,35 @@
+package log_v1
+
+import (
+	"hash/fnv"
+
+	"google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// MaxPartitions bounds the num of partitions of a topic, every one of them is a log with files of its own on every server
+const MaxPartitions = 1024
+
+// NumPartitions returns the num of partitions of a topic created with the config, nil included
+func (c *TopicConfig) NumPartitions() uint32 {
+	if c.GetPartitions() == 0 {
+		return 1
+	}
+	return c.Partitions
+}
+
+// ValidateTopicConfig returns an InvalidArgument error if the config asks for more than MaxPartitions partitions
+func ValidateTopicConfig(config *TopicConfig) error {
+	if config.GetPartitions() > MaxPartitions {
+		return status.Errorf(codes.InvalidArgument, "too many partitions: %d, the max is %d", config.Partitions, MaxPartitions)
+	}
+	return nil
+}
+
+// KeyPartition returns the partition of a topic with the given num of partitions that the records with the key go to.
+// It's the FNV-1a hash of the key, so producers can tell where their records end up without asking the servers.
+func KeyPartition(key []byte, partitions uint32) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % partitions
+}
@@ -0,0 +1,35 @@
+package log_v1
+
+import (
+	"google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// MaxHeaders bounds the num of headers of a record
+const MaxHeaders = 64
+
+// MaxHeadersBytes bounds the size of a record's headers, their names and values put together.
+// Headers are meant for small bits of metadata, what's bigger than that belongs in the value.
+const MaxHeadersBytes = 16 << 10
+
+// ValidateRecord returns an InvalidArgument error if there's no record, or if its headers are over the limits or one of them has no name
+func ValidateRecord(record *Record) error {
+	if record == nil {
+		return status.Error(codes.InvalidArgument, "no record")
+	}
+	headers := record.Headers
+	if len(headers) > MaxHeaders {
+		return status.Errorf(codes.InvalidArgument, "too many headers: %d, the max is %d", len(headers), MaxHeaders)
+	}
+	size := 0
+	for name, value := range headers {
+		if name == "" {
+			return status.Error(codes.InvalidArgument, "header has no name")
+		}
+		size += len(name) + len(value)
+	}
+	if size > MaxHeadersBytes {
+		return status.Errorf(codes.InvalidArgument, "headers too big: %d bytes, the max is %d", size, MaxHeadersBytes)
+	}
+	return nil
+}
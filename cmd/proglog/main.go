@@ -6,9 +6,11 @@ import (
 	"os/signal"
 	"path"
 	"syscall"
+	"time"
 
 	"github.com/innazh/proglog/internal/agent"
 	"github.com/innazh/proglog/internal/config"
+	commitlog "github.com/innazh/proglog/internal/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -58,6 +60,8 @@ func setupFlags(cmd *cobra.Command) error {
 	cmd.Flags().Int("rpc-port", 8400, "Port for RPC clients (and Raft) connections.")
 	cmd.Flags().StringSlice("start-join-addrs", nil, "Serf addresses to join.")
 	cmd.Flags().Bool("bootstrap", false, "Bootstrap the cluster.")
+	cmd.Flags().Bool("read-replica", false, "Join the cluster as a non-voting read replica.")
+	cmd.Flags().Duration("reconcile-interval", time.Minute, "How often the leader reconciles Raft's servers with Serf's members.")
 
 	//Security-related stuff (certs, acl):
 	cmd.Flags().String("acl-model-file", "", "Path to ACL model.")
@@ -71,6 +75,27 @@ func setupFlags(cmd *cobra.Command) error {
 	cmd.Flags().String("peer-tls-key-file", "", "Path to peer tls key.")
 	cmd.Flags().String("peer-tls-ca-file", "", "Path to peer certificate authority.")
 
+	//Durability-related stuff:
+	cmd.Flags().String("sync-policy", commitlog.SyncNever.String(), "When to fsync the log: never, always, periodic or roll.")
+	cmd.Flags().Duration("sync-interval", time.Second, "How often to fsync the log with the periodic sync policy.")
+
+	//Retention-related stuff:
+	cmd.Flags().Uint64("retention-max-bytes", 0, "Max size of the log on disk, 0 for no limit.")
+	cmd.Flags().Duration("retention-max-age", 0, "Max age of the log's segments, 0 for no limit.")
+	cmd.Flags().Uint64("retention-max-records", 0, "Max number of records in the log, 0 for no limit.")
+
+	//Compaction-related stuff:
+	cmd.Flags().Bool("compaction", false, "Keep only the newest record of every key.")
+	cmd.Flags().Duration("compaction-tombstone-retention", 24*time.Hour, "How long to keep tombstones before compacting them away.")
+
+	//Compression-related stuff:
+	cmd.Flags().String("compression", "", "Codec to compress closed segments with, e.g. gzip. Empty for no compression.")
+
+	//Group commit-related stuff:
+	cmd.Flags().Duration("group-commit-max-delay", 0, "How long a produce waits for others to be committed along with it, 0 to disable group commit.")
+	cmd.Flags().Int("group-commit-max-records", 1000, "Max number of records committed together.")
+	cmd.Flags().Int("group-commit-max-bytes", 1<<20, "Max size of the records committed together.")
+
 	return viper.BindPFlags(cmd.Flags())
 }
 
@@ -97,6 +122,8 @@ func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
 	c.cfg.RPCPort = viper.GetInt("rpc-port")
 	c.cfg.StartJoinAddrs = viper.GetStringSlice("start-join-addrs")
 	c.cfg.Bootstrap = viper.GetBool("bootstrap")
+	c.cfg.ReadReplica = viper.GetBool("read-replica")
+	c.cfg.ReconcileInterval = viper.GetDuration("reconcile-interval")
 	c.cfg.ACLModelFile = viper.GetString("acl-mode-file")
 	c.cfg.ACLPolicyFile = viper.GetString("acl-policy-file")
 	c.cfg.ServerTLSConfig.CertFile = viper.GetString("server-tls-cert-file")
@@ -105,6 +132,24 @@ func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
 	c.cfg.PeerTLSConfig.CertFile = viper.GetString("peer-tls-cert-file")
 	c.cfg.PeerTLSConfig.KeyFile = viper.GetString("peer-tls-key-file")
 	c.cfg.PeerTLSConfig.CAFile = viper.GetString("peer-tls-ca-file")
+	c.cfg.SyncPolicy, err = commitlog.ParseSyncPolicy(viper.GetString("sync-policy"))
+	if err != nil {
+		return err
+	}
+	c.cfg.SyncInterval = viper.GetDuration("sync-interval")
+	c.cfg.RetentionMaxBytes = viper.GetUint64("retention-max-bytes")
+	c.cfg.RetentionMaxAge = viper.GetDuration("retention-max-age")
+	c.cfg.RetentionMaxRecords = viper.GetUint64("retention-max-records")
+	c.cfg.Compaction = viper.GetBool("compaction")
+	c.cfg.CompactionTombstoneRetention = viper.GetDuration("compaction-tombstone-retention")
+	if codec := viper.GetString("compression"); codec != "" {
+		if c.cfg.Compression, err = commitlog.LookupCodec(codec); err != nil {
+			return err
+		}
+	}
+	c.cfg.GroupCommitMaxDelay = viper.GetDuration("group-commit-max-delay")
+	c.cfg.GroupCommitMaxRecords = viper.GetInt("group-commit-max-records")
+	c.cfg.GroupCommitMaxBytes = viper.GetInt("group-commit-max-bytes")
 
 	if c.cfg.ServerTLSConfig.CertFile != "" &&
 		c.cfg.ServerTLSConfig.KeyFile != "" {
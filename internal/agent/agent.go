@@ -3,6 +3,7 @@ package agent
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -15,9 +16,11 @@ import (
 	"github.com/innazh/proglog/internal/log"
 	"github.com/innazh/proglog/internal/server"
 	"github.com/soheilhy/cmux"
+	"go.opencensus.io/stats/view"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 // Config is comprised of Agent's data memebers params
@@ -31,11 +34,37 @@ type Config struct {
 	RPCPort   int
 	NodeName  string
 	Bootstrap bool
+	// ReadReplica joins the cluster without a vote, it gets the log replicated and serves consumes
+	// without growing the quorum writes have to wait for. A read replica can't bootstrap the cluster.
+	ReadReplica bool
 
 	StartJoinAddrs []string
+	// ReconcileInterval is how often the leader reconciles Raft's servers with Serf's members, defaults to a minute
+	ReconcileInterval time.Duration
 
 	ACLModelFile  string
 	ACLPolicyFile string
+
+	// durability of the log, see log.SyncPolicy
+	SyncPolicy   log.SyncPolicy
+	SyncInterval time.Duration
+
+	// retention limits of the log, zero means no limit
+	RetentionMaxBytes   uint64
+	RetentionMaxAge     time.Duration
+	RetentionMaxRecords uint64
+
+	// compaction keeps only the newest record of every key, see log.Log.Compact
+	Compaction                   bool
+	CompactionTombstoneRetention time.Duration
+
+	// codec the segments are compressed with once they're no longer active, nil for no compression
+	Compression log.Codec
+
+	// group commit coalesces concurrent appends into a single Raft command, zero GroupCommitMaxDelay disables it
+	GroupCommitMaxDelay   time.Duration
+	GroupCommitMaxRecords int
+	GroupCommitMaxBytes   int
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -53,6 +82,7 @@ type Agent struct {
 	mux        cmux.CMux
 	log        *log.DistributedLog
 	server     *grpc.Server
+	forwarder  *server.Forwarder
 	membership *discovery.Membership
 
 	shutdown     bool
@@ -125,6 +155,10 @@ func (a *Agent) setupLog() error {
 		return bytes.Compare(b, []byte{byte(log.RaftRPC)}) == 0
 	})
 
+	if a.Config.ReadReplica && a.Config.Bootstrap {
+		return errors.New("a read replica can't bootstrap the cluster")
+	}
+
 	logConfig := log.Config{}
 	logConfig.Raft.StreamLayer = log.NewStreamLayer(
 		raftLn,
@@ -140,6 +174,22 @@ func (a *Agent) setupLog() error {
 	logConfig.Raft.BindAddr = rpcAddr
 	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
 	logConfig.Raft.Bootstrap = a.Config.Bootstrap
+	logConfig.Segment.Sync = a.Config.SyncPolicy
+	logConfig.Segment.SyncInterval = a.Config.SyncInterval
+	logConfig.Retention.MaxBytes = a.Config.RetentionMaxBytes
+	logConfig.Retention.MaxAge = a.Config.RetentionMaxAge
+	logConfig.Retention.MaxRecords = a.Config.RetentionMaxRecords
+	logConfig.Compaction.Enabled = a.Config.Compaction
+	logConfig.Compaction.TombstoneRetention = a.Config.CompactionTombstoneRetention
+	logConfig.Compression.Codec = a.Config.Compression
+	logConfig.GroupCommit.MaxDelay = a.Config.GroupCommitMaxDelay
+	logConfig.GroupCommit.MaxRecords = a.Config.GroupCommitMaxRecords
+	logConfig.GroupCommit.MaxBytes = a.Config.GroupCommitMaxBytes
+	if logConfig.GroupCommit.MaxDelay > 0 {
+		if err := view.Register(log.GroupCommitViews...); err != nil {
+			return err
+		}
+	}
 
 	a.log, err = log.NewDistributedLog(
 		a.Config.DataDir,
@@ -164,10 +214,23 @@ func (a *Agent) setupServer() error {
 		return err
 	}
 
+	// followers forward the produce calls they get to the leader over the same port, as a peer
+	var forwardOpts []grpc.DialOption
+	if a.Config.PeerTLSConfig != nil {
+		forwardOpts = append(forwardOpts, grpc.WithTransportCredentials(credentials.NewTLS(a.Config.PeerTLSConfig)))
+	} else {
+		forwardOpts = append(forwardOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	a.forwarder = server.NewForwarder(forwardOpts...)
+
 	serverConfig := &server.Config{
 		CommitLog:   a.log,
+		Topics:      topics{a.log},
+		Producers:   a.log,
 		Authorizer:  authorizer,
 		GetServerer: a.log, //distributed log implements the GetServerer interface
+		Forwarder:   a.forwarder,
+		Admin:       admin{a.log},
 	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
@@ -194,18 +257,50 @@ func (a *Agent) setupMembership() error {
 	if err != nil {
 		return err
 	}
+	role := discovery.RoleVoter
+	if a.Config.ReadReplica {
+		role = discovery.RoleReadReplica
+	}
 	a.membership, err = discovery.NewMembership(a.log, discovery.Config{
 		NodeName: a.Config.NodeName,
 		BindAddr: a.Config.BindAddr,
 		Tags: map[string]string{
-			"rpc_addr": rpcAddr,
+			discovery.RPCAddrTag: rpcAddr,
+			discovery.RoleTag:    role,
 		},
-		StartJoinAddrs: a.Config.StartJoinAddrs,
+		StartJoinAddrs:    a.Config.StartJoinAddrs,
+		ReconcileInterval: a.Config.ReconcileInterval,
 	})
 	return err
 
 }
 
+// topics serves the distributed log's topics to the server, whose Topics interface can't name log.DistributedLog
+type topics struct {
+	*log.DistributedLog
+}
+
+func (t topics) Partition(topic string, partition uint32) (server.CommitLog, error) {
+	p, err := t.DistributedLog.Partition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// admin serves the Raft groups of the distributed log to the Admin service, see topics
+type admin struct {
+	*log.DistributedLog
+}
+
+func (a admin) Group(topic string, partition uint32) (server.Admin, error) {
+	p, err := a.DistributedLog.Partition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return admin{p}, nil
+}
+
 func (a *Agent) serve() error {
 	if err := a.mux.Serve(); err != nil {
 		_ = a.Shutdown()
@@ -231,6 +326,7 @@ func (a *Agent) Shutdown() error {
 			a.server.GracefulStop()
 			return nil
 		},
+		a.forwarder.Close,
 		a.log.Close,
 	}
 
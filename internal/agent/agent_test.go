@@ -1,6 +1,7 @@
 package agent_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 
@@ -42,7 +44,8 @@ func TestAgent(t *testing.T) {
 	require.NoError(t, err)
 
 	var agents []*agent.Agent
-	for i := 0; i < 3; i++ {
+	// the last agent is a read replica
+	for i := 0; i < 4; i++ {
 		//we now need two ports: one for the rpc address(log conns) and one for serf address (discovery conns)
 		ports := dynaport.Get(2)
 		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
@@ -62,6 +65,7 @@ func TestAgent(t *testing.T) {
 		agent, err := agent.NewAgent(agent.Config{
 			NodeName:        fmt.Sprintf("%d", i),
 			Bootstrap:       i == 0,
+			ReadReplica:     i == 3,
 			StartJoinAddrs:  startJoinAddrs,
 			BindAddr:        bindAddr,
 			RPCPort:         rpcPort,
@@ -133,6 +137,191 @@ func TestAgent(t *testing.T) {
 	got := status.Code(err)
 	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
 	require.Equal(t, got, want)
+
+	// the read replica joined without a vote and serves consumes too
+	servers, err := leaderClient.GetServers(context.Background(), &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 4, len(servers.Servers))
+	for _, server := range servers.Servers {
+		require.Equal(t, server.Id == "3", server.Role == api.Role_ROLE_READ_REPLICA)
+	}
+	consumeResponse, err = directClient(t, agents[3], peerTLSConfig).Consume(
+		context.Background(),
+		&api.ConsumeRequest{
+			Offset: produceResponse.Offset,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), consumeResponse.Record.Value)
+
+	// a client that talks to a follower directly still gets to produce, through the leader
+	directClient := directClient(t, agents[1], peerTLSConfig)
+	produceResponse, err = directClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("bar"),
+			},
+		},
+	)
+	require.NoError(t, err)
+	// consume calls go to the followers, give them time to replicate the record
+	require.Eventually(t, func() bool {
+		consumeResponse, err = leaderClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{
+				Offset: produceResponse.Offset,
+			},
+		)
+		return err == nil && bytes.Equal([]byte("bar"), consumeResponse.Record.Value)
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// reads that wait for the commit index of the write see the record right away too
+	produceResponse, err = leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("qux"),
+			},
+		},
+	)
+	require.NoError(t, err)
+	require.NotZero(t, produceResponse.CommitIndex)
+	consumeResponse, err = leaderClient.Consume(
+		context.Background(),
+		&api.ConsumeRequest{
+			Offset:          produceResponse.Offset,
+			MinAppliedIndex: produceResponse.CommitIndex,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte("qux"), consumeResponse.Record.Value)
+
+	// linearizable reads see the record right away, the followers forward them to the leader
+	produceResponse, err = leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("baz"),
+			},
+		},
+	)
+	require.NoError(t, err)
+	consumeResponse, err = leaderClient.Consume(
+		context.Background(),
+		&api.ConsumeRequest{
+			Offset:      produceResponse.Offset,
+			Consistency: api.ReadConsistency_READ_CONSISTENCY_LINEARIZABLE,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte("baz"), consumeResponse.Record.Value)
+
+	// streams follow the log until they're cancelled, and the server waits for them when it's shut down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := directClient.ConsumeStream(
+		ctx,
+		&api.ConsumeRequest{
+			Offset:      produceResponse.Offset,
+			Consistency: api.ReadConsistency_READ_CONSISTENCY_LINEARIZABLE,
+		},
+	)
+	require.NoError(t, err)
+	streamResponse, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("baz"), streamResponse.Record.Value)
+
+	// a retry of an idempotent producer's record gets the offset of the original, the followers forward both to the leader
+	producer, err := directClient.InitProducer(context.Background(), &api.InitProducerRequest{})
+	require.NoError(t, err)
+	require.NotZero(t, producer.ProducerId)
+	idempotent := &api.ProduceRequest{
+		Record:     &api.Record{Value: []byte("payment")},
+		ProducerId: producer.ProducerId,
+	}
+	produceResponse, err = directClient.Produce(context.Background(), idempotent)
+	require.NoError(t, err)
+	retryResponse, err := directClient.Produce(context.Background(), idempotent)
+	require.NoError(t, err)
+	require.Equal(t, produceResponse.Offset, retryResponse.Offset)
+
+	testAdmin(t, agents, peerTLSConfig)
+}
+
+func testAdmin(t *testing.T, agents []*agent.Agent, peerTLSConfig *tls.Config) {
+	ctx := context.Background()
+	leaderAdmin := adminClient(t, agents[0], peerTLSConfig)
+	followerAdmin := adminClient(t, agents[1], peerTLSConfig)
+
+	configuration, err := followerAdmin.GetConfiguration(ctx, &api.GetConfigurationRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 4, len(configuration.Servers))
+	for _, server := range configuration.Servers {
+		if server.Id == "3" {
+			require.Equal(t, api.Suffrage_SUFFRAGE_NONVOTER, server.Suffrage)
+		} else {
+			require.Equal(t, api.Suffrage_SUFFRAGE_VOTER, server.Suffrage)
+		}
+		require.Equal(t, server.Id == "0", server.IsLeader)
+	}
+
+	// membership changes made on a follower are forwarded to the leader
+	_, err = followerAdmin.DemoteServer(ctx, &api.DemoteServerRequest{Id: "2"})
+	require.NoError(t, err)
+	configuration, err = leaderAdmin.GetConfiguration(ctx, &api.GetConfigurationRequest{})
+	require.NoError(t, err)
+	require.Equal(t, api.Suffrage_SUFFRAGE_NONVOTER, configuration.Servers[2].Suffrage)
+
+	snapshot, err := leaderAdmin.Snapshot(ctx, &api.SnapshotRequest{})
+	require.NoError(t, err)
+	require.NotZero(t, snapshot.Index)
+
+	stats, err := leaderAdmin.GetStats(ctx, &api.GetStatsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "Leader", stats.Stats["state"])
+	require.Equal(t, fmt.Sprint(snapshot.Index), stats.Stats["last_snapshot_index"])
+
+	// the partitions' groups can be looked into as well
+	_, err = directClient(t, agents[0], peerTLSConfig).CreateTopic(ctx, &api.CreateTopicRequest{Name: "audit"})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		configuration, err := followerAdmin.GetConfiguration(ctx, &api.GetConfigurationRequest{Topic: "audit"})
+		return err == nil && len(configuration.Servers) == 4
+	}, 3*time.Second, 50*time.Millisecond)
+	stats, err = followerAdmin.GetStats(ctx, &api.GetStatsRequest{Topic: "audit"})
+	require.NoError(t, err)
+	require.NotEmpty(t, stats.Stats["state"])
+	_, err = leaderAdmin.Snapshot(ctx, &api.SnapshotRequest{Topic: "audit", Partition: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	nobodyTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.NobodyClientCertFile,
+		KeyFile:       config.NobodyClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	nobodyAdmin := adminClient(t, agents[0], nobodyTLSConfig)
+	_, err = nobodyAdmin.GetStats(ctx, &api.GetStatsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// directClient connects to the agent only, without going through our resolver and picker
+func directClient(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClient {
+	rpcAddr, err := agent.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(rpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	require.NoError(t, err)
+	return api.NewLogClient(conn)
+}
+
+func adminClient(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.AdminClient {
+	rpcAddr, err := agent.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(rpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	require.NoError(t, err)
+	return api.NewAdminClient(conn)
 }
 
 func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClient {
@@ -2,32 +2,62 @@ package discovery
 
 import (
 	"net"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
+	api "github.com/innazh/proglog/api/v1"
 	"go.uber.org/zap"
 )
 
-// Handler is a component that needs to know when a node leaves or joins the cluster
+// Handler is a component that needs to know when a node leaves or joins the cluster.
+// Voter is false for the members that only serve reads, see RoleTag.
 type Handler interface {
-	Join(name, addr string) error
+	Join(name, addr string, voter bool) error
 	Leave(name string) error
 }
 
+// The tags the members advertise to each other
+const (
+	RPCAddrTag = "rpc_addr"
+	// RoleTag tells whether the member votes or is a read replica, members without it are voters
+	RoleTag         = "role"
+	RoleVoter       = "voter"
+	RoleReadReplica = "read-replica"
+)
+
+/*
+Reconciler is a Handler that takes part in reconciliation: Serf's events only reach the handler of the member that
+happens to get them, and the handler can only act on them when it's the leader. So the leader periodically compares
+its servers with Serf's members, and right away when it becomes the leader, to catch up on what it missed.
+*/
+type Reconciler interface {
+	Handler
+	// GetServers returns the servers the handler has, e.g. Raft's configuration
+	GetServers() ([]*api.Server, error)
+	// LeaderCh delivers true when the handler becomes the leader and false when it stops being it
+	LeaderCh() <-chan bool
+}
+
 type Config struct {
 	NodeName       string
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+	// ReconcileInterval is how often the leader reconciles when the handler is a Reconciler, defaults to a minute
+	ReconcileInterval time.Duration
 }
 
 // Membership is wrapping the Surf library
 type Membership struct {
 	Config
-	handler Handler
-	serf    *serf.Serf
-	events  chan serf.Event
-	logger  *zap.Logger
+	handler  Handler
+	serf     *serf.Serf
+	events   chan serf.Event
+	shutdown chan struct{}
+	stopOnce sync.Once
+	logger   *zap.Logger
 }
 
 func (m *Membership) setupSerf() (err error) {
@@ -60,13 +90,20 @@ func (m *Membership) setupSerf() (err error) {
 
 func NewMembership(handler Handler, conf Config) (*Membership, error) {
 	c := &Membership{
-		Config:  conf,
-		handler: handler,
-		logger:  zap.L().Named("membership"),
+		Config:   conf,
+		handler:  handler,
+		shutdown: make(chan struct{}),
+		logger:   zap.L().Named("membership"),
+	}
+	if c.ReconcileInterval == 0 {
+		c.ReconcileInterval = time.Minute
 	}
 	if err := c.setupSerf(); err != nil {
 		return nil, err
 	}
+	if r, ok := handler.(Reconciler); ok {
+		go c.reconcileLoop(r)
+	}
 	return c, nil
 }
 
@@ -83,7 +120,7 @@ func (m *Membership) eventHandler() {
 		case serf.EventMemberLeave, serf.EventMemberFailed:
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
-					return
+					continue
 				}
 				m.handleLeave(member)
 			}
@@ -94,7 +131,8 @@ func (m *Membership) eventHandler() {
 func (m *Membership) handleJoin(member serf.Member) {
 	if err := m.handler.Join(
 		member.Name,
-		member.Tags["rpc_addr"],
+		member.Tags[RPCAddrTag],
+		member.Tags[RoleTag] != RoleReadReplica,
 	); err != nil {
 		m.logError(err, "failed to join", member)
 	}
@@ -116,14 +154,68 @@ func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+// Leave leaves the cluster and stops reconciling
 func (m *Membership) Leave() error {
+	m.stopOnce.Do(func() { close(m.shutdown) })
 	return m.serf.Leave()
 }
 
+// reconcileLoop reconciles every ReconcileInterval and whenever the handler becomes the leader, for as long as it's the leader
+func (m *Membership) reconcileLoop(r Reconciler) {
+	ticker := time.NewTicker(m.ReconcileInterval)
+	defer ticker.Stop()
+
+	var leader bool
+	for {
+		select {
+		case <-m.shutdown:
+			return
+		case leader = <-r.LeaderCh():
+		case <-ticker.C:
+		}
+		if leader {
+			m.reconcile(r)
+		}
+	}
+}
+
+/*
+reconcile joins the alive members the handler doesn't have yet and makes it leave the servers whose members left or failed.
+Servers Serf doesn't know about, e.g. the ones added through the Admin service, are left alone, and so is the suffrage of
+the servers that already joined, so an operator's demotion sticks.
+*/
+func (m *Membership) reconcile(r Reconciler) {
+	servers, err := r.GetServers()
+	if err != nil {
+		m.logger.Error("failed to get servers to reconcile", zap.Error(err))
+		return
+	}
+	joined := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		joined[server.Id] = true
+	}
+	for _, member := range m.serf.Members() {
+		if m.isLocal(member) {
+			continue
+		}
+		switch member.Status {
+		case serf.StatusAlive:
+			if !joined[member.Name] {
+				m.handleJoin(member)
+			}
+		case serf.StatusLeft, serf.StatusFailed:
+			if joined[member.Name] {
+				m.handleLeave(member)
+			}
+		}
+	}
+}
+
 func (m *Membership) logError(err error, msg string, member serf.Member) {
 	log := m.logger.Error
 
-	if err == raft.ErrNotLeader {
+	// only the leader can change the cluster, the other members are expected to fail
+	if _, ok := err.(api.ErrNotLeader); ok || err == raft.ErrNotLeader {
 		log = m.logger.Debug
 	}
 
@@ -131,6 +223,7 @@ func (m *Membership) logError(err error, msg string, member serf.Member) {
 		msg,
 		zap.Error(err),
 		zap.String("name", member.Name),
-		zap.String("rpc_addr", member.Tags["rpc_addr"]),
+		zap.String("rpc_addr", member.Tags[RPCAddrTag]),
+		zap.String("role", member.Tags[RoleTag]),
 	)
 }
@@ -2,10 +2,12 @@ package discovery
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/serf/serf"
+	api "github.com/innazh/proglog/api/v1"
 	"github.com/travisjeffery/go-dynaport"
 
 	"github.com/stretchr/testify/require"
@@ -33,6 +35,14 @@ func TestMembership(t *testing.T) {
 	}, 3*time.Second, 250*time.Millisecond)
 
 	require.Equal(t, fmt.Sprintf("%d", 2), <-handler.leaves)
+
+	// the read replica joins without a vote
+	voters := map[string]string{}
+	for i := 0; i < 2; i++ {
+		join := <-handler.joins
+		voters[join["id"]] = join["voter"]
+	}
+	require.Equal(t, map[string]string{"1": "true", "2": "false"}, voters)
 }
 
 type handler struct {
@@ -40,11 +50,12 @@ type handler struct {
 	leaves chan string
 }
 
-func (h *handler) Join(id, addr string) error {
+func (h *handler) Join(id, addr string, voter bool) error {
 	if h.joins != nil {
 		h.joins <- map[string]string{
-			"id":   id,
-			"addr": addr,
+			"id":    id,
+			"addr":  addr,
+			"voter": fmt.Sprint(voter),
 		}
 	}
 	return nil
@@ -62,7 +73,10 @@ func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler)
 	ports := dynaport.Get(1)
 	addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
 	tags := map[string]string{
-		"rpc_addr": addr,
+		RPCAddrTag: addr,
+	}
+	if id == 2 {
+		tags[RoleTag] = RoleReadReplica
 	}
 	c := Config{
 		NodeName: fmt.Sprintf("%d", id),
@@ -83,3 +97,112 @@ func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler)
 	members = append(members, m)
 	return members, h
 }
+
+// TestMembershipReconcile checks that the leader catches up on the events it missed while it wasn't the leader
+func TestMembershipReconcile(t *testing.T) {
+	r := &reconciler{servers: map[string]bool{}, leaderCh: make(chan bool, 1)}
+	members := []*Membership{}
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(1)
+		addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+		c := Config{
+			NodeName:          fmt.Sprintf("%d", i),
+			BindAddr:          addr,
+			Tags:              map[string]string{RPCAddrTag: addr},
+			ReconcileInterval: 50 * time.Millisecond,
+		}
+		var h Handler = &handler{}
+		if i == 0 {
+			h = r
+		} else {
+			c.StartJoinAddrs = []string{members[0].BindAddr}
+		}
+		m, err := NewMembership(h, c)
+		require.NoError(t, err)
+		defer m.Leave()
+		members = append(members, m)
+	}
+
+	// the joins are dropped until the handler becomes the leader
+	require.Eventually(t, func() bool {
+		return 3 == len(members[0].Members())
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, 0, r.len())
+	r.setLeader(true)
+	require.Eventually(t, func() bool {
+		return r.has("1") && r.has("2")
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// and so are the leaves
+	r.setLeader(false)
+	require.NoError(t, members[2].Leave())
+	require.Eventually(t, func() bool {
+		return serf.StatusLeft == members[0].Members()[2].Status
+	}, 3*time.Second, 50*time.Millisecond)
+	require.True(t, r.has("2"))
+	r.setLeader(true)
+	require.Eventually(t, func() bool {
+		return r.has("1") && !r.has("2")
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+// reconciler is a handler that only takes the joins and leaves while it's the leader
+type reconciler struct {
+	mu       sync.Mutex
+	leader   bool
+	servers  map[string]bool
+	leaderCh chan bool
+}
+
+func (r *reconciler) Join(id, addr string, voter bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.leader {
+		return api.ErrNotLeader{}
+	}
+	r.servers[id] = true
+	return nil
+}
+
+func (r *reconciler) Leave(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.leader {
+		return api.ErrNotLeader{}
+	}
+	delete(r.servers, id)
+	return nil
+}
+
+func (r *reconciler) GetServers() ([]*api.Server, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	servers := []*api.Server{{Id: "0", IsLeader: r.leader}}
+	for id := range r.servers {
+		servers = append(servers, &api.Server{Id: id})
+	}
+	return servers, nil
+}
+
+func (r *reconciler) LeaderCh() <-chan bool {
+	return r.leaderCh
+}
+
+func (r *reconciler) setLeader(leader bool) {
+	r.mu.Lock()
+	r.leader = leader
+	r.mu.Unlock()
+	r.leaderCh <- leader
+}
+
+func (r *reconciler) has(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.servers[id]
+}
+
+func (r *reconciler) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.servers)
+}
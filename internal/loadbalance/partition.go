@@ -0,0 +1,48 @@
+package loadbalance
+
+import (
+	"context"
+	"hash/fnv"
+	"maps"
+)
+
+// Partition identifies a partition of a topic, see api.Partition
+type Partition struct {
+	Topic string
+	ID    uint32
+}
+
+// Partitions are the partitions a server holds a replica of, and whether it leads them. The resolver attaches them to the server's address.
+type Partitions map[Partition]bool
+
+// Equal lets gRPC compare the attributes of the addresses it's given, maps can't be compared with ==
+func (p Partitions) Equal(o any) bool {
+	other, ok := o.(Partitions)
+	return ok && maps.Equal(p, other)
+}
+
+type partitionContextKey struct{}
+
+/*
+WithPartition returns a context for the calls made on the partition of the topic. The picker sends the produce calls made with it
+to the partition's leader, and the consume calls to the same server holding the partition every time, spreading the different
+partitions over the servers so the consumers of a topic's partitions read from them in parallel.
+*/
+func WithPartition(ctx context.Context, topic string, partition uint32) context.Context {
+	return context.WithValue(ctx, partitionContextKey{}, Partition{Topic: topic, ID: partition})
+}
+
+func partitionFromContext(ctx context.Context) (Partition, bool) {
+	if ctx == nil {
+		return Partition{}, false
+	}
+	p, ok := ctx.Value(partitionContextKey{}).(Partition)
+	return p, ok
+}
+
+// hash spreads the partitions evenly over the servers, the partitions of a topic go to consecutive servers
+func (p Partition) hash() uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(p.Topic))
+	return h.Sum32() + p.ID
+}
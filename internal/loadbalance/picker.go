@@ -17,24 +17,37 @@ type Picker struct {
 	mu        sync.RWMutex
 	leader    balancer.SubConn
 	followers []balancer.SubConn
+	replicas  []balancer.SubConn // read replicas, the consumes go to them when there are any
 	current   uint64
+	// the partitions every conn holds, the calls made WithPartition go to the conns holding theirs
+	partitions map[balancer.SubConn]Partitions
 }
 
-// Build setsup the leader and followers conns, so we can route the consume and produce calls differently
+// Build setsup the leader, followers and read replicas conns, so we can route the consume and produce calls differently
 func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	var followers []balancer.SubConn
+	var followers, replicas []balancer.SubConn
+	partitions := make(map[balancer.SubConn]Partitions)
 	for sc, scInfo := range buildInfo.ReadySCs {
+		// addresses resolved without partitions hold none we know of
+		partitions[sc], _ = scInfo.Address.Attributes.Value("partitions").(Partitions)
 		isLeader := scInfo.Address.Attributes.Value("is_leader").(bool)
 		if isLeader {
 			p.leader = sc
 			continue
 		}
+		// addresses resolved without a role are voters
+		if isReplica, _ := scInfo.Address.Attributes.Value("is_read_replica").(bool); isReplica {
+			replicas = append(replicas, sc)
+			continue
+		}
 		followers = append(followers, sc)
 	}
 	p.followers = followers
+	p.replicas = replicas
+	p.partitions = partitions
 	return p
 }
 
@@ -45,10 +58,24 @@ func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	defer p.mu.RUnlock()
 
 	var result balancer.PickResult
-	if strings.Contains(info.FullMethodName, "Produce") || len(p.followers) == 0 {
+	partition, hasPartition := partitionFromContext(info.Ctx)
+	produce := strings.Contains(info.FullMethodName, "Produce")
+	switch {
+	case produce && hasPartition && p.leading(partition) != nil:
+		// every partition has a leader of its own
+		result.SubConn = p.leading(partition)
+	case produce:
+		result.SubConn = p.leader
+	case hasPartition && p.holding(partition) != nil:
+		result.SubConn = p.holding(partition)
+	case len(p.replicas) > 0:
+		// read replicas are there to take the consumes off the voters
+		result.SubConn = p.next(p.replicas)
+	case len(p.followers) > 0:
+		// consumes and the other reads can be served by any follower
+		result.SubConn = p.next(p.followers)
+	default:
 		result.SubConn = p.leader
-	} else if strings.Contains(info.FullMethodName, "Consume") {
-		result.SubConn = p.nextFollower()
 	}
 	if result.SubConn == nil {
 		return result, balancer.ErrNoSubConnAvailable
@@ -56,12 +83,47 @@ func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	return result, nil
 }
 
-// nextFollower picks the next follower via round robin algorithm
-func (p *Picker) nextFollower() balancer.SubConn {
+// leading returns the conn leading the partition, nil if none of them is known to
+func (p *Picker) leading(partition Partition) balancer.SubConn {
+	for sc, partitions := range p.partitions {
+		if partitions[partition] {
+			return sc
+		}
+	}
+	return nil
+}
+
+// holding picks the conn to consume the partition from, nil if none of them holds it. Like the other consumes, it picks
+// the read replicas first, then the followers of the partition and then its leader.
+func (p *Picker) holding(partition Partition) balancer.SubConn {
+	voters := append([]balancer.SubConn{p.leader}, p.followers...)
+	var replicas, followers, leaders []balancer.SubConn
+	for _, sc := range p.replicas {
+		if _, ok := p.partitions[sc][partition]; ok {
+			replicas = append(replicas, sc)
+		}
+	}
+	for _, sc := range voters {
+		if leads, ok := p.partitions[sc][partition]; ok && leads {
+			leaders = append(leaders, sc)
+		} else if ok {
+			followers = append(followers, sc)
+		}
+	}
+	for _, holding := range [][]balancer.SubConn{replicas, followers, leaders} {
+		if len(holding) > 0 {
+			return holding[partition.hash()%uint32(len(holding))]
+		}
+	}
+	return nil
+}
+
+// next picks the next of the conns via round robin algorithm
+func (p *Picker) next(conns []balancer.SubConn) balancer.SubConn {
 	cur := atomic.AddUint64(&p.current, uint64(1))
-	len := uint64(len(p.followers))
+	len := uint64(len(conns))
 	idx := int(cur % len)
-	return p.followers[idx]
+	return conns[idx]
 }
 
 // init registers the balancer builder to the balancer map
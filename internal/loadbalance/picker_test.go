@@ -1,6 +1,7 @@
 package loadbalance_test
 
 import (
+	"context"
 	"testing"
 
 	"google.golang.org/grpc/attributes"
@@ -71,6 +72,83 @@ func TestPickerConsumesFromFollowers(t *testing.T) {
 	}
 }
 
+func TestPickerConsumesFromReplicas(t *testing.T) {
+	picker, subConns := setupTest()
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for _, sc := range subConns {
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: sc.addrs[0]}
+	}
+	replica := &subConn{}
+	addr := resolver.Address{
+		Attributes: attributes.New("is_leader", false).WithValue("is_read_replica", true),
+	}
+	replica.UpdateAddresses([]resolver.Address{addr})
+	buildInfo.ReadySCs[replica] = base.SubConnInfo{Address: addr}
+	picker.Build(buildInfo)
+
+	for _, method := range []string{"/log.vX.Log/Consume", "/log.vX.Log/ConsumeStream"} {
+		pick, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		require.NoError(t, err)
+		require.Equal(t, replica, pick.SubConn)
+	}
+	pick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.vX.Log/Produce"})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], pick.SubConn)
+}
+
+func TestPickerPartitions(t *testing.T) {
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	// the leader of the metadata group leads the 1st partition and the 1st follower the 2nd,
+	// the 2nd follower only holds the 1st partition
+	holds := []loadbalance.Partitions{
+		{{Topic: "orders", ID: 0}: true, {Topic: "orders", ID: 1}: false},
+		{{Topic: "orders", ID: 0}: false, {Topic: "orders", ID: 1}: true},
+		{{Topic: "orders", ID: 0}: false},
+	}
+	var subConns []*subConn
+	for i, partitions := range holds {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Attributes: attributes.New("is_leader", i == 0).WithValue("partitions", partitions),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := &loadbalance.Picker{}
+	picker.Build(buildInfo)
+
+	pick := func(method string, ctx context.Context) balancer.SubConn {
+		result, err := picker.Pick(balancer.PickInfo{FullMethodName: method, Ctx: ctx})
+		require.NoError(t, err)
+		return result.SubConn
+	}
+	orders0 := loadbalance.WithPartition(context.Background(), "orders", 0)
+	orders1 := loadbalance.WithPartition(context.Background(), "orders", 1)
+	payments := loadbalance.WithPartition(context.Background(), "payments", 0)
+
+	// the produce calls go to the leader of their partition
+	require.Equal(t, subConns[0], pick("/log.vX.Log/Produce", orders0))
+	require.Equal(t, subConns[1], pick("/log.vX.Log/Produce", orders1))
+	require.Equal(t, subConns[0], pick("/log.vX.Log/Produce", payments))
+
+	// a partition is always consumed from the same follower holding it
+	for i := 0; i < 5; i++ {
+		require.Equal(t, subConns[0], pick("/log.vX.Log/Consume", orders1))
+	}
+	first := pick("/log.vX.Log/Consume", orders0)
+	require.NotEqual(t, subConns[0], first)
+	for i := 0; i < 5; i++ {
+		require.Equal(t, first, pick("/log.vX.Log/Consume", orders0))
+	}
+	// a partition no server is known to hold is consumed like any other call
+	require.NotEqual(t, subConns[0], pick("/log.vX.Log/Consume", payments))
+}
+
 func setupTest() (*loadbalance.Picker, []*subConn) {
 	var subConns []*subConn
 	buildInfo := base.PickerBuildInfo{
@@ -83,11 +83,21 @@ func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
 
 	var addrs []resolver.Address
 	for _, server := range res.Servers {
+		partitions := make(Partitions, len(server.Partitions))
+		for _, p := range server.Partitions {
+			partitions[Partition{Topic: p.Topic, ID: p.Id}] = p.IsLeader
+		}
 		addrs = append(addrs, resolver.Address{
 			Addr: server.RpcAddr,
 			Attributes: attributes.New(
 				"is_leader",
 				server.IsLeader,
+			).WithValue(
+				"is_read_replica",
+				server.Role == api.Role_ROLE_READ_REPLICA,
+			).WithValue(
+				"partitions",
+				partitions,
 			),
 		})
 	}
@@ -91,13 +91,18 @@ func TestResolver(t *testing.T) {
 		opts,
 	)
 	require.NoError(t, err)
+	leaderPartitions := loadbalance.Partitions{{Topic: ""}: true, {Topic: "orders", ID: 0}: true, {Topic: "orders", ID: 1}: false}
+	followerPartitions := loadbalance.Partitions{{Topic: ""}: false, {Topic: "orders", ID: 0}: false, {Topic: "orders", ID: 1}: true}
 	wantState := resolver.State{
 		Addresses: []resolver.Address{{
 			Addr:       "localhost:9001",
-			Attributes: attributes.New("is_leader", true),
+			Attributes: attributes.New("is_leader", true).WithValue("is_read_replica", false).WithValue("partitions", leaderPartitions),
 		}, {
 			Addr:       "localhost:9002",
-			Attributes: attributes.New("is_leader", false),
+			Attributes: attributes.New("is_leader", false).WithValue("is_read_replica", false).WithValue("partitions", followerPartitions),
+		}, {
+			Addr:       "localhost:9003",
+			Attributes: attributes.New("is_leader", false).WithValue("is_read_replica", true).WithValue("partitions", loadbalance.Partitions{}),
 		}},
 	}
 	require.Equal(t, wantState, conn.state)
@@ -111,12 +116,19 @@ func TestResolver(t *testing.T) {
 type getServers struct{}
 
 func (s *getServers) GetServers() ([]*api.Server, error) {
+	// every partition has a leader of its own
 	return []*api.Server{{
-		Id:       "leader",
-		RpcAddr:  "localhost:9001",
-		IsLeader: true,
+		Id:         "leader",
+		RpcAddr:    "localhost:9001",
+		IsLeader:   true,
+		Partitions: []*api.Partition{{Topic: "", IsLeader: true}, {Topic: "orders", Id: 0, IsLeader: true}, {Topic: "orders", Id: 1}},
+	}, {
+		Id:         "follower",
+		RpcAddr:    "localhost:9002",
+		Partitions: []*api.Partition{{Topic: ""}, {Topic: "orders", Id: 0}, {Topic: "orders", Id: 1, IsLeader: true}},
 	}, {
-		Id:      "follower",
-		RpcAddr: "localhost:9002",
+		Id:      "replica",
+		RpcAddr: "localhost:9003",
+		Role:    api.Role_ROLE_READ_REPLICA,
 	}}, nil
 }
@@ -0,0 +1,312 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	api "github.com/innazh/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+/*
+A segment is compacted into a directory next to it named <base offset>.compacting, which is renamed to <base offset>.compacted
+once the new segment is complete. The rename is the commit point: on setup, compacted directories are moved over the old segment
+and compacting ones are thrown away, so a crash in the middle of a compaction never leaves a half-written segment behind.
+*/
+const (
+	compactingExt = ".compacting"
+	compactedExt  = ".compacted"
+)
+
+// compaction is a segment that's been compacted but not swapped in yet
+type compaction struct {
+	old *segment
+	dir string // the compacted segment's directory, empty if no records were left
+}
+
+/*
+Compact rewrites the segments that are no longer active so they only keep the newest record of every key among them,
+the records of the active segment don't count until it's no longer active.
+Tombstones (keyed records without a value) are dropped as well once they're older than Compaction.TombstoneRetention,
+and records without a key are always kept. Records keep their offsets, so compacted segments have gaps in them,
+and a segment that's left without any records is removed.
+*/
+func (l *Log) Compact(now time.Time) error {
+	l.mu.RLock()
+	below := l.activeSegment.baseOffset
+	l.mu.RUnlock()
+	return l.compact(below, now)
+}
+
+/*
+compact compacts the records below the given offset: the newest record of a key is the newest one below it, and the records
+from it on are left alone, so every server of a group compacts the same records whatever it appended since. See Compact.
+The active segment isn't compacted, so it mustn't have records below the offset, see rollBefore.
+The segments are rewritten without holding the lock, it's only taken to swap them in.
+*/
+func (l *Log) compact(below uint64, now time.Time) (err error) {
+	l.rewriteMu.Lock()
+	defer l.rewriteMu.Unlock()
+
+	segments := l.acquire(func(s *segment) bool {
+		return s != l.activeSegment && s.baseOffset < below
+	})
+	defer func() {
+		if rerr := releaseAll(segments); err == nil {
+			err = rerr
+		}
+	}()
+	compactions, err := l.prepareCompactions(segments, below, now)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range compactions {
+		if err := l.swap(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareCompactions writes the compacted version of every segment that has something to drop below the given offset
+func (l *Log) prepareCompactions(segments []*segment, below uint64, now time.Time) (compactions []compaction, err error) {
+	defer func() {
+		if err != nil {
+			for _, c := range compactions {
+				os.RemoveAll(c.dir)
+			}
+		}
+	}()
+
+	latest := make(map[string]uint64) // offset of the newest record of every key below the given offset
+	for _, s := range segments {
+		err := s.forEach(func(record *api.Record) error {
+			if len(record.Key) > 0 && record.Offset < below {
+				latest[string(record.Key)] = record.Offset
+			}
+			return nil
+		})
+		if err != nil {
+			return compactions, err
+		}
+	}
+	keep := func(record *api.Record) bool {
+		if len(record.Key) == 0 || record.Offset >= below {
+			return true
+		}
+		if latest[string(record.Key)] != record.Offset {
+			return false
+		}
+		return len(record.Value) > 0 ||
+			now.Sub(time.Unix(0, record.AppendTime)) < l.Config.Compaction.TombstoneRetention
+	}
+
+	for _, s := range segments {
+		var kept, dropped uint64
+		err := s.forEach(func(record *api.Record) error {
+			if keep(record) {
+				kept++
+			} else {
+				dropped++
+			}
+			return nil
+		})
+		if err != nil {
+			return compactions, err
+		}
+		if dropped == 0 {
+			continue
+		}
+		c := compaction{old: s}
+		if kept > 0 {
+			if c.dir, err = l.compactSegment(s, keep); err != nil {
+				return compactions, err
+			}
+		}
+		compactions = append(compactions, c)
+	}
+	return compactions, nil
+}
+
+// compactSegment writes the records of s that should be kept into a new segment and returns the directory it's in
+func (l *Log) compactSegment(s *segment, keep func(*api.Record) bool) (string, error) {
+	dir := filepath.Join(l.Dir, fmt.Sprintf("%d%s", s.baseOffset, compactingExt))
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", err
+	}
+	// the new segment is synced once when it's closed
+	c := l.Config
+	c.Segment.Sync = SyncNever
+	compacted, err := newSegment(dir, s.baseOffset, c)
+	if err != nil {
+		return "", err
+	}
+	err = s.forEach(func(record *api.Record) error {
+		if !keep(record) {
+			return nil
+		}
+		_, err := compacted.appendAt(record)
+		return err
+	})
+	if err != nil {
+		compacted.Close()
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if err = compacted.Close(); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	done := filepath.Join(l.Dir, fmt.Sprintf("%d%s", s.baseOffset, compactedExt))
+	if err = os.Rename(dir, done); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return done, nil
+}
+
+// swap replaces the old segment with its compacted version, or removes it if nothing was left. The caller must hold the lock.
+func (l *Log) swap(c compaction) error {
+	i := -1
+	for j, s := range l.segments {
+		if s == c.old {
+			i = j
+		}
+	}
+	// the segment was truncated away while it was being compacted, or truncated after and made active again
+	if i == -1 || c.old == l.activeSegment {
+		return os.RemoveAll(c.dir)
+	}
+
+	if c.dir == "" {
+		if err := c.old.Remove(); err != nil {
+			return err
+		}
+		l.segments = append(l.segments[:i], l.segments[i+1:]...)
+		return nil
+	}
+	if err := c.old.Close(); err != nil {
+		return err
+	}
+	if err := moveCompacted(l.Dir, c.dir); err != nil {
+		return err
+	}
+	s, err := newSegment(l.Dir, c.old.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	l.segments[i] = s
+	return nil
+}
+
+// moveCompacted moves the files of a compacted segment over the old segment's files and removes its directory.
+// It's safe to call again if it didn't get to finish before.
+func moveCompacted(dir, compactedDir string) error {
+	files, err := os.ReadDir(compactedDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		// the compacted store replaces the old one whether it was compressed or not
+		if ext := path.Ext(file.Name()); ext == ".store" {
+			compressed := strings.TrimSuffix(file.Name(), ext) + compressedExt
+			if err := os.Remove(filepath.Join(dir, compressed)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(filepath.Join(compactedDir, file.Name()), filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(compactedDir)
+}
+
+// finishRewrites swaps in the segments that were compacted before the log was closed,
+// and cleans up the compactions and compressions that didn't get to finish.
+func (l *Log) finishRewrites() error {
+	files, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := filepath.Join(l.Dir, file.Name())
+		switch path.Ext(file.Name()) {
+		case compactedExt:
+			err = moveCompacted(l.Dir, name)
+		case compactingExt, compressingExt:
+			err = os.RemoveAll(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactLoop periodically compacts the log until it's closed
+func (l *Log) compactLoop(closed <-chan struct{}) {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.Config.Compaction.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			if err := l.Compact(time.Now()); err != nil {
+				zap.L().Named("log").Error("failed to compact log", zap.String("dir", l.Dir), zap.Error(err))
+			}
+		}
+	}
+}
+
+// forEach calls fn with every record in the segment, skipping the gaps left by compaction
+func (s *segment) forEach(fn func(*api.Record) error) error {
+	for off := s.baseOffset; off < s.nextOffset; {
+		record, err := s.readFrom(off)
+		if err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+		off = record.Offset + 1
+	}
+	return nil
+}
+
+// acquire holds on to the segments that match, see segment.acquire. They have to be released with releaseAll.
+func (l *Log) acquire(match func(*segment) bool) []*segment {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var segments []*segment
+	for _, s := range l.segments {
+		if match(s) {
+			s.acquire()
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
+
+// releaseAll releases the segments, returning the first error it runs into
+func releaseAll(segments []*segment) error {
+	var err error
+	for _, s := range segments {
+		if rerr := s.release(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,388 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Codec compresses and decompresses the blocks of a closed segment's store
+type Codec interface {
+	// Name identifies the codec in the compressed files, so they can be read back whatever codec is configured at the time
+	Name() string
+	Compress(p []byte) ([]byte, error)
+	Decompress(p []byte) ([]byte, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+
+	errCompressedStore = errors.New("log: compressed store is read-only")
+)
+
+// RegisterCodec makes the codec available for reading the files it compressed, under its name
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// LookupCodec returns the registered codec with the given name
+func LookupCodec(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec: %q", name)
+	}
+	return c, nil
+}
+
+func init() {
+	RegisterCodec(GzipCodec{})
+}
+
+// GzipCodec compresses with gzip from the standard library
+type GzipCodec struct {
+	Level int // gzip's compression level, zero means gzip.DefaultCompression
+}
+
+func (GzipCodec) Name() string {
+	return "gzip"
+}
+
+func (c GzipCodec) Compress(p []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(p); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCodec) Decompress(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+/*
+A compressed store is written next to the segment as <base offset>.compressing and renamed to <base offset>.cstore once it's complete,
+then the original store is removed. The store is compressed in blocks of Compression.BlockSize bytes, so reading a record only
+decompresses the blocks it's in. The index keeps pointing at the positions in the uncompressed store.
+
+The file starts with a header: the magic bytes, the codec's name (1 byte of length + name), the block size, the uncompressed size
+and the num of blocks (8 bytes each), followed by the end of every compressed block relative to the start of the data (8 bytes each),
+and the compressed blocks themselves.
+*/
+const (
+	compressedMagic = "PLZ1"
+	compressedExt   = ".cstore"
+	compressingExt  = ".compressing"
+)
+
+// compressedReader reads a compressed store as if it wasn't compressed. It's not safe for concurrent use, the store's lock guards it.
+type compressedReader struct {
+	file      *os.File
+	codec     Codec
+	blockSize uint64
+	size      uint64   // size of the uncompressed store
+	fileSize  uint64   // size of the compressed file
+	dataStart uint64   // position of the first block in the file
+	ends      []uint64 // end of every block, relative to dataStart
+
+	// the last decompressed block, since the records are mostly read in order
+	cached int64
+	block  []byte
+}
+
+// writeCompressed compresses size bytes read from src into f, in blocks of blockSize bytes.
+// The blocks are written as they're compressed, the block table they leave room for is filled in once their sizes are known.
+func writeCompressed(f *os.File, src io.ReaderAt, size, blockSize uint64, codec Codec) error {
+	blocks := (size + blockSize - 1) / blockSize
+	name := codec.Name()
+	header := make([]byte, 0, len(compressedMagic)+1+len(name)+3*8+int(blocks)*8)
+	header = append(header, compressedMagic...)
+	header = append(header, byte(len(name)))
+	header = append(header, name...)
+	header = enc.AppendUint64(header, blockSize)
+	header = enc.AppendUint64(header, size)
+	header = enc.AppendUint64(header, blocks)
+	tablePos := len(header)
+	header = header[:tablePos+int(blocks)*8]
+	if _, err := f.Write(header); err != nil {
+		return err
+	}
+
+	table := header[tablePos:]
+	p := make([]byte, blockSize)
+	var end uint64
+	for i := uint64(0); i < blocks; i++ {
+		off := i * blockSize
+		n := min(blockSize, size-off)
+		if _, err := src.ReadAt(p[:n], int64(off)); err != nil {
+			return err
+		}
+		block, err := codec.Compress(p[:n])
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(block); err != nil {
+			return err
+		}
+		end += uint64(len(block))
+		enc.PutUint64(table[i*8:], end)
+	}
+	if _, err := f.WriteAt(table, int64(tablePos)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// newCompressedStore opens the compressed store in f, reading its header and block table
+func newCompressedStore(f *os.File) (*store, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := &compressedReader{file: f, fileSize: uint64(fi.Size()), cached: -1}
+
+	header := make([]byte, len(compressedMagic)+1)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:len(compressedMagic)]) != compressedMagic {
+		return nil, fmt.Errorf("log: %s is not a compressed store", f.Name())
+	}
+	pos := uint64(len(header))
+	fields := make([]byte, int(header[len(compressedMagic)])+3*8)
+	if _, err = f.ReadAt(fields, int64(pos)); err != nil {
+		return nil, err
+	}
+	pos += uint64(len(fields))
+	nameLen := len(fields) - 3*8
+	if r.codec, err = LookupCodec(string(fields[:nameLen])); err != nil {
+		return nil, err
+	}
+	r.blockSize = enc.Uint64(fields[nameLen:])
+	r.size = enc.Uint64(fields[nameLen+8:])
+	blocks := enc.Uint64(fields[nameLen+16:])
+	if r.blockSize == 0 || blocks != (r.size+r.blockSize-1)/r.blockSize || blocks*8 > r.fileSize {
+		return nil, fmt.Errorf("log: %s has a corrupt header", f.Name())
+	}
+
+	table := make([]byte, blocks*8)
+	if _, err = f.ReadAt(table, int64(pos)); err != nil {
+		return nil, err
+	}
+	r.dataStart = pos + uint64(len(table))
+	r.ends = make([]uint64, blocks)
+	for i := range r.ends {
+		r.ends[i] = enc.Uint64(table[i*8:])
+	}
+
+	s := &store{
+		File:       f,
+		size:       r.size,
+		buf:        bufio.NewWriter(f),
+		compressed: r,
+	}
+	if err = s.readFormat(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ReadAt reads len(p) bytes of the uncompressed store, beginning at off
+func (r *compressedReader) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) && uint64(off) < r.size {
+		i := uint64(off) / r.blockSize
+		block, err := r.readBlock(int64(i))
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], block[uint64(off)-i*r.blockSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readBlock decompresses the i-th block. A block that can't be decompressed is reported as a checksum mismatch,
+// the same as a corrupt record in an uncompressed store.
+func (r *compressedReader) readBlock(i int64) ([]byte, error) {
+	if i == r.cached {
+		return r.block, nil
+	}
+	var start uint64
+	if i > 0 {
+		start = r.ends[i-1]
+	}
+	end := r.ends[i]
+	if end < start || r.dataStart+end > r.fileSize {
+		return nil, errChecksumMismatch
+	}
+	p := make([]byte, end-start)
+	if _, err := r.file.ReadAt(p, int64(r.dataStart+start)); err != nil {
+		return nil, err
+	}
+	block, err := r.codec.Decompress(p)
+	want := min(r.blockSize, r.size-uint64(i)*r.blockSize)
+	if err != nil || uint64(len(block)) != want {
+		return nil, errChecksumMismatch
+	}
+	r.cached, r.block = i, block
+	return block, nil
+}
+
+// decompress replaces the segment's compressed store with a regular one.
+// The compressed store is only removed once the regular one is complete, and wins over it if we don't get that far.
+func (s *segment) decompress() error {
+	compressedName := s.store.Name()
+	name := strings.TrimSuffix(compressedName, compressedExt) + ".store"
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, io.NewSectionReader(s.store, 0, int64(s.store.size))); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	store, err := newStore(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	store.syncOnAppend = s.config.Segment.Sync == SyncAlways
+	if err = s.store.Close(); err != nil {
+		return err
+	}
+	s.store = store
+	return os.Remove(compressedName)
+}
+
+// compressLoop compresses the segments that are no longer active, every time the log moves on to a new segment, until it's closed
+func (l *Log) compressLoop(closed <-chan struct{}, rolled <-chan struct{}) {
+	defer l.wg.Done()
+	for {
+		if err := l.compressSegments(); err != nil {
+			zap.L().Named("log").Error("failed to compress segments", zap.String("dir", l.Dir), zap.Error(err))
+		}
+		select {
+		case <-closed:
+			return
+		case <-rolled:
+		}
+	}
+}
+
+// compressSegments compresses every segment that's no longer active and isn't compressed yet
+func (l *Log) compressSegments() (err error) {
+	l.rewriteMu.Lock()
+	defer l.rewriteMu.Unlock()
+
+	segments := l.acquire(func(s *segment) bool {
+		return s != l.activeSegment && s.store.compressed == nil
+	})
+	defer func() {
+		if rerr := releaseAll(segments); err == nil {
+			err = rerr
+		}
+	}()
+	for _, s := range segments {
+		if err := l.compressSegment(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compressSegment writes the compressed copy of the segment's store without holding the lock, then swaps it in.
+// The segment must be held, see acquire.
+func (l *Log) compressSegment(s *segment) error {
+	tmp := filepath.Join(l.Dir, fmt.Sprintf("%d%s", s.baseOffset, compressingExt))
+	if err := l.writeCompressed(s, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the segment was truncated away in the meantime, or truncated after and made active again
+	if !l.hasSegment(s) || s == l.activeSegment {
+		return os.Remove(tmp)
+	}
+	name := filepath.Join(l.Dir, fmt.Sprintf("%d%s", s.baseOffset, compressedExt))
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	compressed, err := newCompressedStore(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// the segment's readers, snapshots included, only get to its store under the lock, so none of them is reading the old one
+	old := s.store
+	s.store = compressed
+	if err := old.Close(); err != nil {
+		return err
+	}
+	return os.Remove(old.Name())
+}
+
+// writeCompressed writes the compressed copy of the segment's store to the file with the given name.
+// Closed segments aren't written to, so it doesn't need the lock.
+func (l *Log) writeCompressed(s *segment, name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeCompressed(f, s.store, s.store.size, l.Config.Compression.BlockSize, l.Config.Compression.Codec)
+}
+
+// hasSegment tells whether s is still one of the log's segments. The caller must hold the lock.
+func (l *Log) hasSegment(s *segment) bool {
+	for _, segment := range l.segments {
+		if segment == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/innazh/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedStore(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "compressed_store_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+
+	cf, err := os.CreateTemp(os.TempDir(), "compressed_store_test")
+	require.NoError(t, err)
+	defer os.Remove(cf.Name())
+	// blocks smaller than a record, so records span several of them
+	require.NoError(t, writeCompressed(cf, s, s.size, 16, GzipCodec{}))
+
+	c, err := newCompressedStore(cf)
+	require.NoError(t, err)
+	require.Equal(t, s.size, c.size)
+	testRead(t, c)
+	testReadAt(t, c)
+
+	_, _, err = c.Append(testRecord)
+	require.Equal(t, errCompressedStore, err)
+
+	// a corrupt block is reported the same as a corrupt record
+	r := c.compressed
+	_, err = cf.WriteAt([]byte{0xff}, int64(r.dataStart+r.ends[0]+2))
+	require.NoError(t, err)
+	r.cached = -1
+	_, err = c.Read(0)
+	require.Equal(t, errChecksumMismatch, err)
+	require.NoError(t, c.Close())
+
+	_, err = LookupCodec("gzip")
+	require.NoError(t, err)
+	_, err = LookupCodec("lz5")
+	require.Error(t, err)
+}
+
+func TestLogCompression(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-compression-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	c.Compression.Codec = GzipCodec{}
+	c.Compression.BlockSize = 512
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	value := bytes.Repeat([]byte(`{"service":"payments","enabled":true}`), 8)
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Key: []byte{byte('a' + i%5)}, Value: value})
+		require.NoError(t, err)
+	}
+	// records are compressed in the background once their segment is no longer active
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return log.segments[0].store.compressed != nil && log.segments[1].store.compressed != nil
+	}, time.Second, 10*time.Millisecond)
+	require.FileExists(t, filepath.Join(dir, "0"+compressedExt))
+	require.NoFileExists(t, filepath.Join(dir, "0.store"))
+	require.FileExists(t, filepath.Join(dir, "8.store"))
+	log.mu.RLock()
+	require.Less(t, log.segments[0].store.diskSize(), log.segments[0].store.size/2)
+	log.mu.RUnlock()
+
+	check := func(log *Log) {
+		for off := uint64(0); off < 10; off++ {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, read.Offset)
+			require.Equal(t, value, read.Value)
+		}
+		// snapshots read the uncompressed records
+		reader := log.Reader()
+		b, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		var size uint64
+		log.mu.RLock()
+		for _, s := range log.segments {
+			size += s.store.size - s.store.begin()
+		}
+		log.mu.RUnlock()
+		require.Equal(t, size, uint64(len(b)))
+	}
+	check(log)
+	require.NoError(t, log.Close())
+
+	n, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Nil(t, n.Repairs())
+	check(n)
+
+	// compacting a compressed segment replaces its compressed store: the records superseded below the active segment go,
+	// [0, 2] of [0, 3], the ones of the active segment's keys are only dropped once it's no longer active
+	require.NoError(t, n.Compact(time.Now()))
+	_, err = n.Read(2)
+	require.Equal(t, api.ErrOffsetNotFound{Offset: 2}, err)
+	batch, err := n.ReadBatch(0, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), batch[0].Offset)
+	require.NoError(t, n.Close())
+
+	n, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for off := uint64(3); off < 10; off++ {
+		_, err = n.Read(off)
+		require.NoError(t, err)
+	}
+	batch, err = n.ReadBatch(0, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), batch[0].Offset)
+	require.NoError(t, n.Close())
+}
+
+func TestLogTruncateAfterCompressed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-compression-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	c.Compression.Codec = GzipCodec{}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return log.segments[0].store.compressed != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// the compressed segment is decompressed so it can be appended to again
+	require.NoError(t, log.TruncateAfter(1))
+	require.NoFileExists(t, filepath.Join(dir, "0"+compressedExt))
+	require.NoFileExists(t, filepath.Join(dir, "4.store"))
+	off, err := log.Append(&api.Record{Value: []byte("conflict")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	for i, want := range []string{"hello world", "hello world", "conflict"} {
+		read, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), read.Value)
+	}
+	require.NoError(t, log.Close())
+}
+
+func TestLogReaderWhileCompressing(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-compression-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: bytes.Repeat([]byte("payments"), 16)})
+		require.NoError(t, err)
+	}
+	reader := log.Reader()
+	want, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	// the segments are compressed halfway through a snapshot, which carries on with the compressed stores
+	reader = log.Reader()
+	defer reader.Close()
+	got := make([]byte, 10)
+	_, err = io.ReadFull(reader, got)
+	require.NoError(t, err)
+	log.Config.Compression.Codec = GzipCodec{}
+	log.Config.Compression.BlockSize = 512
+	require.NoError(t, log.compressSegments())
+	require.NotNil(t, log.segments[0].store.compressed)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want, append(got, rest...))
+}
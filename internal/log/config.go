@@ -1,6 +1,11 @@
 package log
 
-import "github.com/hashicorp/raft"
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
 
 type Config struct {
 	Raft struct {
@@ -13,5 +18,84 @@ type Config struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// Sync decides when the store and index are fsynced, trading durability for write throughput
+		Sync         SyncPolicy
+		SyncInterval time.Duration // used by SyncPeriodic, defaults to a second
+		// TimeIndexInterval is the num of records between two entries of the sparse time index, defaults to 32
+		TimeIndexInterval uint64
+	}
+	// Retention limits how much of the log is kept around. Only whole segments that are no longer active get removed,
+	// so the log can go over the limits by up to a segment. A zero value means no limit.
+	Retention struct {
+		MaxBytes      uint64        // total size of the segments' store and index files
+		MaxAge        time.Duration // how long a segment is kept after its newest record was appended
+		MaxRecords    uint64
+		CheckInterval time.Duration // how often the limits are enforced, defaults to a minute
+	}
+	// Compaction rewrites the segments that are no longer active to keep only the newest record of every key, see Log.Compact.
+	// Records without a key are never compacted away.
+	Compaction struct {
+		Enabled bool
+		// TombstoneRetention is how long a tombstone (a keyed record without a value) is kept after it was appended,
+		// so consumers get a chance to see the delete before it's compacted away
+		TombstoneRetention time.Duration
+		Interval           time.Duration // how often the log is compacted, defaults to a minute
+	}
+	// Compression compresses the stores of the segments once they're no longer active.
+	// They're decompressed transparently when read, a block at a time.
+	Compression struct {
+		Codec     Codec  // nil disables compression, e.g. GzipCodec{}
+		BlockSize uint64 // num of bytes of the store compressed together, defaults to 64KiB
+	}
+	// Groups are the Raft groups of the topics' partitions, every partition is replicated by a group of its own
+	Groups struct {
+		// ReconcileInterval is how often the leader of a partition's group brings the group's servers in line with the
+		// metadata group's, and hands leadership over to the server it's spread to. Defaults to 10 seconds.
+		ReconcileInterval time.Duration
+	}
+	// GroupCommit makes DistributedLog coalesce the appends that arrive close together into a single Raft command,
+	// trading a little latency for throughput. See GroupCommitViews for the metrics to tune it with.
+	GroupCommit struct {
+		MaxDelay   time.Duration // how long an append waits for others to join its batch, zero disables group commit
+		MaxRecords int           // a batch is committed as soon as it has this many records, defaults to 1000
+		MaxBytes   int           // or this many bytes of records, defaults to 1MiB
+	}
+}
+
+// SyncPolicy defines when appended records are forced to stable storage
+type SyncPolicy uint8
+
+const (
+	// SyncNever leaves it to the page cache, records are only fsynced when a segment is closed
+	SyncNever SyncPolicy = iota
+	// SyncAlways fsyncs the store and index on every append
+	SyncAlways
+	// SyncPeriodic fsyncs the active segment every Segment.SyncInterval
+	SyncPeriodic
+	// SyncOnRoll fsyncs a segment once it's maxed out and the log moves on to a new one
+	SyncOnRoll
+)
+
+var syncPolicyNames = map[SyncPolicy]string{
+	SyncNever:    "never",
+	SyncAlways:   "always",
+	SyncPeriodic: "periodic",
+	SyncOnRoll:   "roll",
+}
+
+func (p SyncPolicy) String() string {
+	if name, ok := syncPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", p)
+}
+
+// ParseSyncPolicy returns the policy with the given name: never, always, periodic or roll
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	for p, n := range syncPolicyNames {
+		if n == name {
+			return p, nil
+		}
 	}
+	return SyncNever, fmt.Errorf("unknown sync policy: %q", name)
 }
@@ -2,27 +2,50 @@ package log
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	api "github.com/innazh/proglog/api/v1"
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
 )
 
-// DistributedLog will have the same API as Log to make them interchangeable. Implements discovery.Handler, server.GetServerer, server.CommitLog
+/*
+DistributedLog will have the same API as Log to make them interchangeable. Implements discovery.Handler, server.GetServerer, server.CommitLog.
+
+Every DistributedLog is a Raft group. The one NewDistributedLog creates is the metadata group: its own methods read and write
+the default topic, and it replicates the topics. Every partition of the other topics is a DistributedLog with a Raft group of its
+own, reached through Partition, so the writes of different partitions are committed by different leaders.
+*/
 type DistributedLog struct {
 	config Config
-	log    *Log
+	log    *Log // the default topic, or the partition's records
+	fsm    *fsm
 
-	raft *raft.Raft
+	raft        *raft.Raft
+	raftLog     *logStore
+	stableStore *raftboltdb.BoltStore
+	transport   *transport
+	bootstrap   []raft.Server // the servers a partition's group starts with, if this server is one of them
+
+	batcher     *batcher                 // nil unless group commit is enabled
+	compactions chan *api.CompactRequest // the latest compaction applied that the compactor has yet to pick up
+
+	ready  chan struct{} // closed once the Raft instance is set up
+	closed chan struct{} // closed along with the log to stop the janitor, the batcher and the partition's reconciliation
+	wg     sync.WaitGroup
 }
 
 func (l *DistributedLog) setupLog(dataDir string) error {
@@ -31,8 +54,13 @@ func (l *DistributedLog) setupLog(dataDir string) error {
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return err
 	}
+	// compaction goes through Raft, so every server compacts the same records, see janitor
+	logConfig := l.config
+	logConfig.Compaction.Enabled = false
 	var err error
-	l.log, err = NewLog(logDir, l.config)
+	l.log, err = NewLog(logDir, logConfig)
+	// The user log is derived from Raft's log: on start Raft restores the latest snapshot and applies the entries after it again.
+	// The log is kept rather than rebuilt, it's only cut back to where the snapshot was taken, see fsm.restoreLog.
 	return err
 }
 
@@ -40,7 +68,8 @@ func (l *DistributedLog) setupLog(dataDir string) error {
 func (l *DistributedLog) setupRaft(dataDir string) error {
 	var err error
 
-	fsm := &fsm{log: l.log}
+	fsm := newFSM(l, filepath.Join(dataDir, "topics"))
+	l.fsm = fsm
 
 	// We will use our own log implementation as Raft's log store.
 	// This is where Raft will store the commands that will be processed by the FSM.
@@ -50,10 +79,15 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	}
 	logConfig := l.config
 	logConfig.Segment.InitialOffset = 1
+	// Raft relies on every entry of its log staying where it was put,
+	// and reads back the entries followers are missing, so its log isn't compacted or compressed
+	logConfig.Compaction.Enabled = false
+	logConfig.Compression.Codec = nil
 	logStore, err := newLogStore(logDir, logConfig)
 	if err != nil {
 		return err
 	}
+	l.raftLog = logStore
 
 	//key-val store where Raft stores important metadata (server's curr term, candidate server voted for)
 	stableStore, err := raftboltdb.NewBoltStore(
@@ -62,6 +96,7 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if err != nil {
 		return err
 	}
+	l.stableStore = stableStore
 
 	/*snapshot to recover and restore data
 	the absence of a snapshot would put all of the load on the leader - to stream the data to another instance until its up-to-date.
@@ -77,15 +112,27 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if err != nil {
 		return err
 	}
+	// without a snapshot, Raft applies every entry of its log again, and the user log only has records of those entries
+	snapshots, err := snapshotStore.List()
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		if err = l.log.rollback(l.config.Segment.InitialOffset); err != nil {
+			return err
+		}
+	}
 
 	maxPool := 5
 	timeout := 10 * time.Second
-	transport := raft.NewNetworkTransport(
+	l.transport = newTransport(raft.NewNetworkTransport(
 		l.config.Raft.StreamLayer,
 		maxPool,
 		timeout,
 		os.Stderr,
-	)
+	))
+	l.wg.Add(1)
+	go l.transport.forward(l.closed, &l.wg)
 
 	config := raft.DefaultConfig()
 	config.LocalID = l.config.Raft.LocalID //unique server ID
@@ -110,11 +157,13 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 		logStore,
 		stableStore,
 		snapshotStore,
-		transport,
+		l.transport,
 	)
 	if err != nil {
 		return err
 	}
+	// the snapshots taken before there were topics don't tell the fsm the index they're at, Raft knows it once it restored them
+	fsm.setApplied(l.raft.AppliedIndex())
 	hasState, err := raft.HasExistingState(
 		logStore,
 		stableStore,
@@ -123,6 +172,10 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if err != nil {
 		return err
 	}
+	//a partition's group is bootstrapped by all of its servers at once, with the same configuration
+	if len(l.bootstrap) > 0 && !hasState {
+		return l.raft.BootstrapCluster(raft.Configuration{Servers: l.bootstrap}).Error()
+	}
 	//generally boostrapping is only necessary when starting out cluster with a first server, configured at the only voter.
 	//It then becomes a leader and can add more servers.
 	if l.config.Raft.Bootstrap && !hasState {
@@ -138,8 +191,17 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 }
 
 func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
+	return newDistributedLog(dataDir, config, nil)
+}
+
+// newDistributedLog creates the log of a Raft group, bootstrapping the group with the servers given if it's new
+func newDistributedLog(dataDir string, config Config, bootstrap []raft.Server) (*DistributedLog, error) {
 	l := &DistributedLog{
-		config: config,
+		config:      config,
+		bootstrap:   bootstrap,
+		compactions: make(chan *api.CompactRequest, 1),
+		ready:       make(chan struct{}),
+		closed:      make(chan struct{}),
 	}
 	if err := l.setupLog(dataDir); err != nil {
 		return nil, err
@@ -147,56 +209,281 @@ func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
 	if err := l.setupRaft(dataDir); err != nil {
 		return nil, err
 	}
+	close(l.ready)
+	if l.config.GroupCommit.MaxDelay > 0 {
+		l.batcher = newBatcher(l.config, l.closed, l.AppendBatchIndexed)
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.batcher.run()
+		}()
+	}
+	// every server compacts, whatever its own config says, the leader's janitor decides when
+	l.wg.Add(1)
+	go l.compactor()
+	r := l.config.Retention
+	if r.MaxBytes > 0 || r.MaxAge > 0 || r.MaxRecords > 0 || l.config.Compaction.Enabled {
+		l.wg.Add(1)
+		go l.janitor()
+	}
 	return l, nil
 }
 
-// Append appends the record to the log
+/*
+janitor enforces the retention limits and compacts the log until the log is closed.
+Only the leader decides what to remove, the removal itself is replicated through Raft so every server drops the same segments,
+and compacts the same records.
+*/
+func (l *DistributedLog) janitor() {
+	defer l.wg.Done()
+	var retention, compaction <-chan time.Time
+	if r := l.config.Retention; r.MaxBytes > 0 || r.MaxAge > 0 || r.MaxRecords > 0 {
+		interval := r.CheckInterval
+		if interval == 0 {
+			interval = time.Minute
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		retention = ticker.C
+	}
+	if l.config.Compaction.Enabled {
+		ticker := time.NewTicker(l.log.Config.Compaction.Interval)
+		defer ticker.Stop()
+		compaction = ticker.C
+	}
+	for {
+		var err error
+		select {
+		case <-l.closed:
+			return
+		case <-retention:
+			if l.raft.State() == raft.Leader {
+				err = l.enforceRetention()
+			}
+		case <-compaction:
+			if l.raft.State() == raft.Leader {
+				err = l.compact()
+			}
+		}
+		if _, notLeader := err.(api.ErrNotLeader); err != nil && !notLeader {
+			zap.L().Named("janitor").Error("failed to tidy up the log", zap.Error(err))
+		}
+	}
+}
+
+// enforceRetention replicates the truncation of the segments that exceed the retention limits
+func (l *DistributedLog) enforceRetention() error {
+	cutoff := l.log.retentionCutoff(time.Now())
+	lowest, err := l.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	if cutoff <= lowest {
+		return nil
+	}
+	_, _, err = l.apply(TruncateRequestType, &api.TruncateRequest{Lowest: cutoff})
+	return err
+}
+
+// compact replicates the compaction of the records below the leader's active segment, see Log.Compact
+func (l *DistributedLog) compact() error {
+	l.log.mu.RLock()
+	below := l.log.activeSegment.baseOffset
+	l.log.mu.RUnlock()
+	_, _, err := l.apply(CompactRequestType, &api.CompactRequest{Below: below, Now: time.Now().UnixNano()})
+	return err
+}
+
+// compactor carries out the compactions applied to the local log, one at a time, until the log is closed
+func (l *DistributedLog) compactor() {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.closed:
+			return
+		case req := <-l.compactions:
+			if err := l.log.compact(req.Below, time.Unix(0, req.Now)); err != nil {
+				zap.L().Named("compactor").Error("failed to compact log", zap.String("dir", l.log.Dir), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Append appends the record to the log. With group commit enabled, it's committed along with the other appends made around the same time.
 func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
-	res, err := l.apply(
+	offset, _, err := l.AppendIndexed(record)
+	return offset, err
+}
+
+// AppendIndexed appends the record like Append, and returns the index of the Raft entry it was committed with as well,
+// which reads of the record can wait for on any server with WaitApplied
+func (l *DistributedLog) AppendIndexed(record *api.Record) (offset, index uint64, err error) {
+	if l.batcher != nil {
+		return l.batcher.append(record)
+	}
+	res, index, err := l.apply(
 		AppendRequestType,
 		&api.ProduceRequest{Record: record},
 	)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	return res.(*api.ProduceResponse).Offset, nil
+	return res.(*api.ProduceResponse).Offset, index, nil
 }
 
+// AppendBatch appends the records to the log with a single Raft command, so the whole batch costs one round of consensus
+func (l *DistributedLog) AppendBatch(records []*api.Record) (first, last uint64, err error) {
+	first, last, _, err = l.AppendBatchIndexed(records)
+	return first, last, err
+}
+
+// AppendBatchIndexed appends the records like AppendBatch, and returns the index of their Raft entry as well, see AppendIndexed
+func (l *DistributedLog) AppendBatchIndexed(records []*api.Record) (first, last, index uint64, err error) {
+	res, index, err := l.apply(
+		AppendBatchRequestType,
+		&api.ProduceBatchRequest{Records: records},
+	)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	batch := res.(*api.ProduceBatchResponse)
+	return batch.FirstOffset, batch.LastOffset, index, nil
+}
+
+// apply commits the request with Raft and returns the fsm's response to it, along with the index of the entry it was committed with
 func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 	interface{},
+	uint64,
 	error,
 ) {
 	var buf bytes.Buffer
 	_, err := buf.Write([]byte{byte(reqType)})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	b, err := proto.Marshal(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	_, err = buf.Write(b)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	timeout := 10 * time.Second
 	future := l.raft.Apply(buf.Bytes(), timeout)
-	if future.Error() != nil {
-		return nil, future.Error()
+	if err := future.Error(); err != nil {
+		return nil, 0, l.leaderErr(err)
 	}
 	res := future.Response()
 	if err, ok := res.(error); ok {
-		return nil, err
+		return nil, 0, err
+	}
+	return res, future.Index(), nil
+}
+
+// leaderErr turns Raft's ErrNotLeader into api.ErrNotLeader, so clients learn where to go instead.
+// Servers are reachable over gRPC at the address they're known by to Raft.
+func (l *DistributedLog) leaderErr(err error) error {
+	if err == raft.ErrNotLeader {
+		return api.ErrNotLeader{LeaderAddr: string(l.raft.Leader())}
 	}
-	return res, nil
+	return err
 }
 
 func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
 	return l.log.Read(offset)
 }
 
-// Join adds the server to Raft's cluster
-func (l *DistributedLog) Join(id, addr string) error {
+/*
+VerifyRead checks that the local log is up to date enough to be read from with the given consistency:
+  - linearizable reads need every record acknowledged so far, so they go through a barrier that only the leader can commit
+    and that's applied after every entry before it
+  - bounded reads are fine on the leader, and on a follower that's applied all but maxLag of the entries the leader last said
+    were committed and has heard from the leader within maxStaleness
+
+It returns api.ErrNotLeader if the read should be served by the leader instead.
+*/
+func (l *DistributedLog) VerifyRead(consistency api.ReadConsistency, maxLag uint64, maxStaleness time.Duration) error {
+	switch consistency {
+	case api.ReadConsistency_READ_CONSISTENCY_ANY:
+		return nil
+	case api.ReadConsistency_READ_CONSISTENCY_LINEARIZABLE:
+		timeout := 10 * time.Second
+		return l.leaderErr(l.raft.Barrier(timeout).Error())
+	case api.ReadConsistency_READ_CONSISTENCY_BOUNDED:
+		if l.raft.State() == raft.Leader {
+			return nil
+		}
+		// the follower's own commit index doesn't count the entries it has yet to receive, the leader's does
+		var lag uint64
+		if commit, applied := l.transport.leaderCommit.Load(), l.AppliedIndex(); commit > applied {
+			lag = commit - applied
+		}
+		if (maxLag > 0 && lag > maxLag) || (maxStaleness > 0 && time.Since(l.raft.LastContact()) > maxStaleness) {
+			return api.ErrNotLeader{LeaderAddr: string(l.raft.Leader())}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown read consistency: %v", consistency)
+}
+
+// AppliedIndex returns the index of the last Raft entry applied to the local log
+func (l *DistributedLog) AppliedIndex() uint64 {
+	applied, _ := l.fsm.appliedIndex()
+	return applied
+}
+
+// WaitApplied blocks until the local log has applied the Raft entry at index, or ctx is done.
+// The index of an append is handed out by AppendIndexed, so the append can be read back from any server once it's applied.
+func (l *DistributedLog) WaitApplied(ctx context.Context, index uint64) error {
+	for {
+		applied, advanced := l.fsm.appliedIndex()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-advanced:
+		}
+	}
+}
+
+// ReadBatch reads consecutive records from the local log, see Log.ReadBatch
+func (l *DistributedLog) ReadBatch(off uint64, maxRecords int, maxBytes uint64) ([]*api.Record, error) {
+	return l.log.ReadBatch(off, maxRecords, maxBytes)
+}
+
+// Wait blocks until the local log has a record at off or after it, see Log.Wait
+func (l *DistributedLog) Wait(ctx context.Context, off uint64) error {
+	return l.log.Wait(ctx, off)
+}
+
+// LowestOffset returns the lowest offset in the local log
+func (l *DistributedLog) LowestOffset() (uint64, error) {
+	return l.log.LowestOffset()
+}
+
+// HighestOffset returns the highest offset in the local log
+func (l *DistributedLog) HighestOffset() (uint64, error) {
+	return l.log.HighestOffset()
+}
+
+// NextOffset returns the offset the next record will be appended at in the local log
+func (l *DistributedLog) NextOffset() (uint64, error) {
+	return l.log.NextOffset()
+}
+
+// OffsetForTime returns the offset of the first record appended at or after ts (unix nanoseconds) in the local log
+func (l *DistributedLog) OffsetForTime(ts int64) (uint64, error) {
+	return l.log.OffsetForTime(ts)
+}
+
+/*
+Join adds the server to Raft's cluster. A nonvoter gets the log replicated without taking part in elections or commits,
+that's how read replicas join. Joining a server that's already there with a different suffrage promotes or demotes it.
+*/
+func (l *DistributedLog) Join(id, addr string, voter bool) error {
 	configFuture := l.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		return err
@@ -206,19 +493,31 @@ func (l *DistributedLog) Join(id, addr string) error {
 	for _, srv := range configFuture.Configuration().Servers {
 		if srv.ID == serverID || srv.Address == serverAddr {
 			if srv.ID == serverID && srv.Address == serverAddr {
-				// server has already joined
-				return nil
+				if (srv.Suffrage == raft.Voter) == voter {
+					// server has already joined
+					return nil
+				}
+				if !voter {
+					return l.leaderErr(l.raft.DemoteVoter(serverID, 0, 0).Error())
+				}
+				// adding a nonvoter as a voter promotes it
+				break
 			}
 			// remove the existing server
 			removeFuture := l.raft.RemoveServer(serverID, 0, 0)
 			if err := removeFuture.Error(); err != nil {
-				return err
+				return l.leaderErr(err)
 			}
 		}
 	}
-	addFuture := l.raft.AddVoter(serverID, serverAddr, 0, 0) //the server is able to vote
+	var addFuture raft.IndexFuture
+	if voter {
+		addFuture = l.raft.AddVoter(serverID, serverAddr, 0, 0) //the server is able to vote
+	} else {
+		addFuture = l.raft.AddNonvoter(serverID, serverAddr, 0, 0)
+	}
 	if err := addFuture.Error(); err != nil {
-		return err
+		return l.leaderErr(err)
 	}
 	return nil
 }
@@ -226,7 +525,74 @@ func (l *DistributedLog) Join(id, addr string) error {
 // Leave removes the server from the cluster. Removing a leader will lead to the election.
 func (l *DistributedLog) Leave(id string) error {
 	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
-	return removeFuture.Error()
+	return l.leaderErr(removeFuture.Error())
+}
+
+// Demote turns the voter into a nonvoter, it keeps getting the log replicated
+func (l *DistributedLog) Demote(id string) error {
+	return l.leaderErr(l.raft.DemoteVoter(raft.ServerID(id), 0, 0).Error())
+}
+
+// TransferLeadership hands leadership over to the server with the given id, or to the most up to date voter if id is empty
+func (l *DistributedLog) TransferLeadership(id string) error {
+	if id == "" {
+		return l.leaderErr(l.raft.LeadershipTransfer().Error())
+	}
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) {
+			return l.leaderErr(l.raft.LeadershipTransferToServer(srv.ID, srv.Address).Error())
+		}
+	}
+	return fmt.Errorf("unknown server: %q", id)
+}
+
+// Snapshot takes a snapshot of the local log right away, rather than waiting for Raft to decide it's time for one
+func (l *DistributedLog) Snapshot() (*api.SnapshotResponse, error) {
+	future := l.raft.Snapshot()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	meta, r, err := future.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.Close(); err != nil {
+		return nil, err
+	}
+	return &api.SnapshotResponse{Id: meta.ID, Index: meta.Index, Term: meta.Term}, nil
+}
+
+// Stats exposes Raft's stats of the local server, e.g. its state, term and indexes
+func (l *DistributedLog) Stats() map[string]string {
+	return l.raft.Stats()
+}
+
+// GetConfiguration exposes the servers of Raft's configuration, along with whether they can vote
+func (l *DistributedLog) GetConfiguration() ([]*api.RaftServer, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	suffrages := map[raft.ServerSuffrage]api.Suffrage{
+		raft.Voter:    api.Suffrage_SUFFRAGE_VOTER,
+		raft.Nonvoter: api.Suffrage_SUFFRAGE_NONVOTER,
+		raft.Staging:  api.Suffrage_SUFFRAGE_STAGING,
+	}
+	leader := l.raft.Leader()
+	var servers []*api.RaftServer
+	for _, server := range future.Configuration().Servers {
+		servers = append(servers, &api.RaftServer{
+			Id:       string(server.ID),
+			RpcAddr:  string(server.Address),
+			Suffrage: suffrages[server.Suffrage],
+			IsLeader: leader == server.Address,
+		})
+	}
+	return servers, nil
 }
 
 // WaitForLeader blocks until the cluster has elected a leader or times out.
@@ -246,27 +612,73 @@ func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 	}
 }
 
-// Close shuts down the Raft intance and closes the local log.
+// Close stops the janitor and the batcher, shuts down the Raft intance and closes the local log, along with the partitions' logs.
 func (l *DistributedLog) Close() error {
+	close(l.closed)
+	l.wg.Wait()
 	f := l.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
 	}
+	if err := l.raftLog.Close(); err != nil {
+		return err
+	}
+	if err := l.stableStore.Close(); err != nil {
+		return err
+	}
+	if err := l.fsm.closeTopics(); err != nil {
+		return err
+	}
 	return l.log.Close()
 }
 
-// GetServers exposes Raft's server data
+// LeaderCh delivers true when this server becomes the leader and false when it stops being it.
+// Raft has a single channel for it, so there can only be one receiver, e.g. discovery.Membership's reconciliation.
+func (l *DistributedLog) LeaderCh() <-chan bool {
+	return l.raft.LeaderCh()
+}
+
+// GetServers exposes Raft's server data, along with the partitions every server holds and which of them it leads
 func (l *DistributedLog) GetServers() ([]*api.Server, error) {
 	future := l.raft.GetConfiguration()
 	if err := future.Error(); err != nil {
 		return nil, err
 	}
+	// the default topic is replicated by the metadata group, the partitions of the other topics by groups of their own
+	leader := l.raft.Leader()
+	partitions := make(map[raft.ServerAddress][]*api.Partition)
+	for _, server := range future.Configuration().Servers {
+		partitions[server.Address] = []*api.Partition{{Topic: defaultTopic, IsLeader: leader == server.Address}}
+	}
+	for _, g := range l.fsm.groups() {
+		groupFuture := g.log.raft.GetConfiguration()
+		if err := groupFuture.Error(); err == raft.ErrRaftShutdown {
+			// the topic was deleted in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		groupLeader := g.log.raft.Leader()
+		for _, server := range groupFuture.Configuration().Servers {
+			partitions[server.Address] = append(partitions[server.Address], &api.Partition{
+				Topic:    g.topic,
+				Id:       g.partition,
+				IsLeader: groupLeader == server.Address,
+			})
+		}
+	}
 	var servers []*api.Server
 	for _, server := range future.Configuration().Servers {
+		role := api.Role_ROLE_VOTER
+		if server.Suffrage == raft.Nonvoter {
+			role = api.Role_ROLE_READ_REPLICA
+		}
 		servers = append(servers, &api.Server{
-			Id:       string(server.ID),
-			RpcAddr:  string(server.Address),
-			IsLeader: l.raft.Leader() == server.Address,
+			Id:         string(server.ID),
+			RpcAddr:    string(server.Address),
+			IsLeader:   leader == server.Address,
+			Role:       role,
+			Partitions: partitions[server.Address],
 		})
 	}
 	return servers, nil
@@ -276,14 +688,73 @@ func (l *DistributedLog) GetServers() ([]*api.Server, error) {
 var _ raft.FSM = (*fsm)(nil)
 
 type fsm struct {
-	log *Log
+	dl  *DistributedLog // the group the fsm replicates, the topics' groups are made after it
+	log *Log            // the default topic, or the partition's records
+	dir string          // the other topics' partitions go in its subdirectories
+
+	topicsMu sync.RWMutex
+	topics   map[string]*topic
+
+	// the idempotent producers by id. Only Raft's fsm goroutine gets to them, through Apply, Snapshot and Restore.
+	producers map[uint64][]producerBatch
+	// the offset and time of the latest compaction applied, only the fsm goroutine gets to them too
+	compactBelow uint64
+	compactNow   int64
+
+	mu       sync.Mutex
+	applied  uint64        // index of the last Raft entry applied to the log
+	advanced chan struct{} // closed and replaced every time an entry is applied, to wake up the callers of WaitApplied
+}
+
+func newFSM(dl *DistributedLog, dir string) *fsm {
+	return &fsm{
+		dl:        dl,
+		log:       dl.log,
+		dir:       dir,
+		topics:    make(map[string]*topic),
+		producers: make(map[uint64][]producerBatch),
+		advanced:  make(chan struct{}),
+	}
+}
+
+// setApplied records that the entries up to index have been applied
+func (f *fsm) setApplied(index uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if index <= f.applied {
+		return
+	}
+	f.applied = index
+	close(f.advanced)
+	f.advanced = make(chan struct{})
+}
+
+// appliedIndex returns the index of the last entry applied, and a channel that's closed once another one is
+func (f *fsm) appliedIndex() (uint64, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.applied, f.advanced
+}
+
+var _ raft.ConfigurationStore = (*fsm)(nil)
+
+// StoreConfiguration is invoked once a configuration change is committed. There's nothing to store, but it makes Raft count
+// the change as applied, without it Raft refuses to snapshot until the next record is appended.
+func (f *fsm) StoreConfiguration(index uint64, _ raft.Configuration) {
+	f.setApplied(index)
 }
 
 type RequestType uint8
 
 const (
 	//can add more request types here
-	AppendRequestType RequestType = 0
+	AppendRequestType       RequestType = 0
+	TruncateRequestType     RequestType = 1
+	AppendBatchRequestType  RequestType = 2
+	CreateTopicRequestType  RequestType = 3
+	DeleteTopicRequestType  RequestType = 4
+	InitProducerRequestType RequestType = 5
+	CompactRequestType      RequestType = 6
 )
 
 /*
@@ -292,22 +763,42 @@ Apply applies the record/cmd from Raft's Log to our FSM. It is configured to be
 Raft invokes this method after commiting a log entry.
 */
 func (l *fsm) Apply(record *raft.Log) interface{} {
+	defer l.setApplied(record.Index)
 	buf := record.Data
 	reqType := RequestType(buf[0])
 	switch reqType {
 	case AppendRequestType:
-		return l.applyAppend(buf[1:])
+		return l.applyAppend(buf[1:], record.AppendedAt)
+	case TruncateRequestType:
+		return l.applyTruncate(buf[1:])
+	case AppendBatchRequestType:
+		return l.applyAppendBatch(buf[1:], record.AppendedAt)
+	case CreateTopicRequestType:
+		return l.applyCreateTopic(buf[1:], record.Index)
+	case DeleteTopicRequestType:
+		return l.applyDeleteTopic(buf[1:])
+	case InitProducerRequestType:
+		return &api.InitProducerResponse{ProducerId: record.Index}
+	case CompactRequestType:
+		return l.applyCompact(buf[1:])
 	}
 	return nil
 }
 
-// applyAppend handles the append request, parses the msg into the req object and then appends the record to the Log (CommitLog)
-func (l *fsm) applyAppend(b []byte) interface{} {
+/*
+applyAppend handles the append request, parses the msg into the req object and then appends the record to the Log (CommitLog).
+
+The record is stamped with the time the leader appended the command to Raft's log, so every server ends up with the same append time.
+*/
+func (l *fsm) applyAppend(b []byte, appendedAt time.Time) interface{} {
 	var req api.ProduceRequest
 	err := proto.Unmarshal(b, &req)
 	if err != nil {
 		return err
 	}
+	if !appendedAt.IsZero() {
+		req.Record.AppendTime = appendedAt.UnixNano()
+	}
 	offset, err := l.log.Append(req.Record)
 	if err != nil {
 		return err
@@ -315,64 +806,309 @@ func (l *fsm) applyAppend(b []byte) interface{} {
 	return &api.ProduceResponse{Offset: offset}
 }
 
+// applyAppendBatch appends all the records of the batch request to the Log, or none of them.
+// The batches of idempotent producers are deduplicated, see DistributedLog.AppendIdempotent.
+func (l *fsm) applyAppendBatch(b []byte, appendedAt time.Time) interface{} {
+	var req api.ProduceBatchRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if req.ProducerId != 0 {
+		res, err := l.dedupe(&req)
+		if err != nil {
+			return err
+		}
+		if res != nil {
+			return res
+		}
+	}
+	if !appendedAt.IsZero() {
+		for _, record := range req.Records {
+			record.AppendTime = appendedAt.UnixNano()
+		}
+	}
+	first, last, err := l.log.AppendBatch(req.Records)
+	if err != nil {
+		return err
+	}
+	if req.ProducerId != 0 {
+		l.appended(req.ProducerId, producerBatch{first: req.Sequence, last: req.Sequence + uint64(len(req.Records)) - 1, offset: first})
+	}
+	return &api.ProduceBatchResponse{FirstOffset: first, LastOffset: last}
+}
+
+// applyTruncate removes the segments whose records are all below the requested lowest offset
+func (l *fsm) applyTruncate(b []byte) interface{} {
+	var req api.TruncateRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if req.Lowest == 0 {
+		return nil
+	}
+	if err := l.log.Truncate(req.Lowest - 1); err != nil {
+		return err
+	}
+	return nil
+}
+
+/*
+applyCompact hands the compaction over to the compactor, rewriting the segments would hold up the entries applied after it.
+The records below the requested offset are moved out of the active segment first, since it's never compacted.
+Compactions can be carried out late and skipped, as long as a later one is carried out: it compacts below the same offset
+or a higher one, and at the same time or a later one, so it drops everything the skipped one would have.
+*/
+func (l *fsm) applyCompact(b []byte) interface{} {
+	var req api.CompactRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	// a new leader may propose before it's applied its predecessor's compactions, or have a clock that's behind
+	req.Below = max(req.Below, l.compactBelow)
+	req.Now = max(req.Now, l.compactNow)
+	l.compactBelow, l.compactNow = req.Below, req.Now
+	if err := l.log.rollBefore(req.Below); err != nil {
+		return err
+	}
+	for {
+		select {
+		case l.dl.compactions <- &req:
+			return nil
+		case <-l.dl.compactions: // the compactor has yet to pick up the last one, this one makes up for it
+		}
+	}
+}
+
 /*
 Snapshot is called accodring to the SnapshotInterval(how often) and SnapshotThreshold(how many logs since last one) config params.
 
 Snapshot helps Raft to compact its log (so it doesn't store the cmds that have already been applied), and helps to bootstrap new servers
 */
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	r := f.log.Reader()
-	return &snapshot{reader: r}, nil
+	f.topicsMu.RLock()
+	defer f.topicsMu.RUnlock()
+
+	// the partitions of the other topics are in the snapshots of their own groups
+	applied, _ := f.appliedIndex()
+	topics := []*api.Topic{{Name: defaultTopic}}
+	for _, name := range f.topicNames() {
+		t := f.topics[name]
+		topics = append(topics, &api.Topic{Name: name, Config: t.config, Id: t.id})
+	}
+	next, err := f.log.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+	// the producers are encoded right away, Persist runs alongside the entries applied after the snapshot
+	return &snapshot{
+		applied:   applied,
+		next:      next,
+		producers: encodeProducers(f.producers),
+		topics:    topics,
+		reader:    f.log.Reader(),
+	}, nil
 }
 
 var _ raft.FSMSnapshot = (*snapshot)(nil)
 
+/*
+snapshot holds the topics: it starts with snapshotMagic, a frame with the index of the last entry applied and the offset of the
+log's next record, and a frame with the idempotent producers' latest batches, followed by a frame with the api.Topic of every topic. The default topic's frame is followed by the frames of its log, up to an empty frame.
+A frame is its length followed by its bytes.
+*/
 type snapshot struct {
-	reader io.Reader
+	applied   uint64
+	next      uint64 // the offset the log's next record got, it's past the last record if compaction removed the records at the end
+	producers []byte // see encodeProducers
+	topics    []*api.Topic
+	reader    io.ReadCloser // of the default topic's log, it holds on to the log's segments until the snapshot is released
 }
 
+/*
+snapshotMagic starts the snapshots that hold every topic. The snapshots taken before there were topics only hold the records
+of the default topic, they start with the length of the first record instead, whose first byte is always zero.
+*/
+var snapshotMagic = []byte("proglog\x01")
+
 // Persist writes the snapshot into some kind of store (in our case - it's in file, but could also use an S3 bucket or have it in memory)
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
-	if _, err := io.Copy(sink, s.reader); err != nil {
+	if err := s.persist(sink); err != nil {
 		_ = sink.Cancel()
 		return err
 	}
 	return sink.Close()
 }
 
-func (s *snapshot) Release() {}
+func (s *snapshot) persist(w io.Writer) error {
+	if _, err := w.Write(snapshotMagic); err != nil {
+		return err
+	}
+	applied := make([]byte, 16)
+	enc.PutUint64(applied, s.applied)
+	enc.PutUint64(applied[8:], s.next)
+	if err := writeFrame(w, applied); err != nil {
+		return err
+	}
+	if err := writeFrame(w, s.producers); err != nil {
+		return err
+	}
+	for _, t := range s.topics {
+		b, err := proto.Marshal(t)
+		if err != nil {
+			return err
+		}
+		if err = writeFrame(w, b); err != nil {
+			return err
+		}
+		if t.Name != defaultTopic {
+			continue
+		}
+		fw := &frameWriter{w: w}
+		if _, err = io.Copy(fw, s.reader); err != nil {
+			return err
+		}
+		if err = writeFrame(w, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release lets go of the log's segments, the ones removed in the meantime are closed
+func (s *snapshot) Release() {
+	if err := s.reader.Close(); err != nil {
+		zap.L().Named("snapshot").Error("failed to release the log's segments", zap.Error(err))
+	}
+}
 
 // Restore is called by Raft tto restore an FSM from a snapshot (e.g. launching new server)
 func (f *fsm) Restore(r io.ReadCloser) error {
-	b := make([]byte, recordLenBytes)
+	f.producers = make(map[uint64][]producerBatch)
+	head := make([]byte, len(snapshotMagic))
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF {
+		return f.restoreTopics(nil, 0)
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if !bytes.Equal(head[:n], snapshotMagic) {
+		// the snapshot was taken before there were topics, or checksums: it's the records of the log, framed as length | record
+		if err := f.restoreTopics(nil, 0); err != nil {
+			return err
+		}
+		return restoreLog(f.log, io.MultiReader(bytes.NewReader(head[:n]), r), f.dl.config.Segment.InitialOffset, true)
+	}
+
+	b, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	applied := enc.Uint64(b)
+	next := enc.Uint64(b[8:])
+	if b, err = readFrame(r); err != nil {
+		return err
+	}
+	if f.producers, err = decodeProducers(b); err != nil {
+		return err
+	}
+	var topics []*api.Topic
+	for {
+		b, err := readFrame(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		t := &api.Topic{}
+		if err = proto.Unmarshal(b, t); err != nil {
+			return err
+		}
+		if t.Name == defaultTopic {
+			if err = f.restoreLog(&frameReader{r: r}, next); err != nil {
+				return err
+			}
+			continue
+		}
+		topics = append(topics, t)
+	}
+	if err := f.restoreTopics(topics, applied); err != nil {
+		return err
+	}
+	f.setApplied(applied)
+	return nil
+}
+
+/*
+restoreLog brings the log in line with the snapshot's records, read from r, next is the offset the log's next record got.
+When the log already has the records, e.g. when the server restarts from a snapshot of its own, it's only cut back to where
+it was: Raft applies the entries after the snapshot again. Otherwise the log's records are replaced with the snapshot's.
+*/
+func (f *fsm) restoreLog(r io.Reader, next uint64) error {
+	lowest, err := f.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	cur, err := f.log.NextOffset()
+	if err != nil {
+		return err
+	}
+	if next < lowest || next > cur {
+		return restoreLog(f.log, r, next, false)
+	}
+	if err = f.log.rollback(next); err != nil {
+		return err
+	}
+	// the snapshot goes on after the records
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// restoreLog replaces the log's records with the ones read from r, in the format of Log.Reader, or without the checksums if legacy.
+// The log's next record gets next, or the offset after the last record restored if that's higher.
+func restoreLog(log *Log, r io.Reader, next uint64, legacy bool) error {
+	b := make([]byte, recordHeaderBytes)
+	if legacy {
+		b = b[:recordLenBytes]
+	}
 	var buf bytes.Buffer
-	for i := 0; ; i++ {
+	restored := false
+	for {
 		_, err := io.ReadFull(r, b)
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
-		size := int64(enc.Uint64(b))
+		size := int64(enc.Uint64(b[:recordLenBytes]))
 		if _, err = io.CopyN(&buf, r, size); err != nil {
 			return err
 		}
+		if !legacy && crc32.Checksum(buf.Bytes(), crcTable) != enc.Uint32(b[recordLenBytes:]) {
+			return errChecksumMismatch
+		}
 		record := &api.Record{}
 		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
 			return err
 		}
-		if i == 0 {
-			f.log.Config.Segment.InitialOffset = record.Offset
-			if err := f.log.Reset(); err != nil {
+		if !restored {
+			log.Config.Segment.InitialOffset = record.Offset
+			if err := log.Reset(); err != nil {
 				return err
 			}
+			restored = true
 		}
-		if _, err = f.log.Append(record); err != nil {
+		// a compacted log has gaps in it, so records are restored at the offsets they were taken at
+		if _, err = log.appendAt(record); err != nil {
 			return err
 		}
 		buf.Reset()
 	}
-	return nil
+	if !restored {
+		log.Config.Segment.InitialOffset = next
+		return log.Reset()
+	}
+	return log.skipTo(next)
 }
 
 // Log store definition:
@@ -404,12 +1140,20 @@ func (l *logStore) LastIndex() (uint64, error) {
 func (l *logStore) GetLog(index uint64, out *raft.Log) error {
 	in, err := l.Read(index)
 	if err != nil {
+		// there's no entry at index, e.g. after DeleteRange removed the whole log
+		switch err.(type) {
+		case api.ErrOffsetNotFound, api.ErrOffsetOutOfRange:
+			return raft.ErrLogNotFound
+		}
 		return err
 	}
 	out.Data = in.Value
 	out.Index = in.Offset
 	out.Type = raft.LogType(in.Type)
 	out.Term = in.Term
+	if in.AppendTime != 0 {
+		out.AppendedAt = time.Unix(0, in.AppendTime)
+	}
 	return nil
 }
 
@@ -420,37 +1164,108 @@ func (l *logStore) StoreLog(record *raft.Log) error {
 
 func (l *logStore) StoreLogs(records []*raft.Log) error {
 	for _, record := range records {
-		if _, err := l.Append(&api.Record{
-			Value: record.Data,
-			Term:  record.Term,
-			Type:  uint32(record.Type),
-		}); err != nil {
+		r := &api.Record{
+			Value:  record.Data,
+			Offset: record.Index,
+			Term:   record.Term,
+			Type:   uint32(record.Type),
+		}
+		// followers apply the entries they read back from here, so keep the leader's append time around for the fsm
+		if !record.AppendedAt.IsZero() {
+			r.AppendTime = record.AppendedAt.UnixNano()
+		}
+		// entries are stored at their index, so the log stays in line with Raft's even if DeleteRange emptied it
+		if _, err := l.appendAt(r); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// DeleteRange removes the records between the offsets. It's used for removing the old records or the records stored in a snapshot.
+/*
+DeleteRange removes the records between the offsets, inclusive. Raft only ever deletes from one of the ends of the log:
+from the front to get rid of the records stored in a snapshot,
+and from the back to get rid of the records that conflict with a new leader's after a leader change.
+Deleting the whole log goes through TruncateAfter, so Truncate never gets to the active segment, which it would keep:
+the front deletions leave the last index in place, and the last index is in the active segment.
+*/
 func (l *logStore) DeleteRange(min, max uint64) error {
+	last, err := l.LastIndex()
+	if err != nil {
+		return err
+	}
+	if max >= last && min > 0 {
+		return l.TruncateAfter(min - 1)
+	}
 	return l.Truncate(max)
 }
 
+/*
+transport is Raft's network transport, it keeps the commit index of the last AppendEntries request from the leader, which
+tells how far behind the leader this server is. The heartbeats don't carry it.
+*/
+type transport struct {
+	*raft.NetworkTransport
+	rpcs         chan raft.RPC
+	leaderCommit atomic.Uint64
+}
+
+func newTransport(t *raft.NetworkTransport) *transport {
+	return &transport{NetworkTransport: t, rpcs: make(chan raft.RPC)}
+}
+
+// Consumer delivers the RPCs to Raft once forward has seen them
+func (t *transport) Consumer() <-chan raft.RPC {
+	return t.rpcs
+}
+
+// forward hands the transport's RPCs on to Raft until closed is, noting the leader's commit index on the way
+func (t *transport) forward(closed <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	rpcs := t.NetworkTransport.Consumer()
+	for {
+		select {
+		case rpc := <-rpcs:
+			if req, ok := rpc.Command.(*raft.AppendEntriesRequest); ok {
+				t.leaderCommit.Store(req.LeaderCommitIndex)
+			}
+			select {
+			case t.rpcs <- rpc:
+			case <-closed:
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
 // Raft uses a stream layer in the transport to provide a low-lvl stream abstraction to connect with Raft servers.
 var _ raft.StreamLayer = (*StreamLayer)(nil)
 
+/*
+StreamLayer carries the Raft RPCs of a single Raft group. The groups of a server share its listener: every conn starts with
+the RaftRPC byte, for the agent's mux to tell it apart from the gRPC conns, followed by the name of the group it's for.
+NewStreamLayer creates the layer of the metadata group, the layers of the partitions' groups are made from it with Group.
+*/
 type StreamLayer struct {
-	ln              net.Listener
+	mux   *streamMux
+	group string
+	conns chan net.Conn // the conns the mux accepted for the group
+	done  chan struct{} // closed along with the layer
+	close sync.Once
+
 	serverTLSConfig *tls.Config
 	peerTLSConfig   *tls.Config
 }
 
 func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
-	return &StreamLayer{
-		ln:              ln,
-		serverTLSConfig: serverTLSConfig, // secure server-to-server communication
-		peerTLSConfig:   peerTLSConfig,   //secure outgoing conns
-	}
+	return newStreamMux(ln).layer(metadataGroup, serverTLSConfig, peerTLSConfig)
+}
+
+// Group returns the stream layer of another Raft group on the same listener, with the same TLS configs
+func (s *StreamLayer) Group(group string) *StreamLayer {
+	return s.mux.layer(group, s.serverTLSConfig, s.peerTLSConfig)
 }
 
 const RaftRPC = 1
@@ -463,8 +1278,10 @@ func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.
 		return nil, err
 	}
 
-	// identify to mux this is a raft rpc
-	_, err = conn.Write([]byte{byte(RaftRPC)})
+	// identify to mux this is a raft rpc, and to the server's stream mux which group it's for
+	header := []byte{byte(RaftRPC), 0, 0}
+	enc.PutUint16(header[1:], uint16(len(s.group)))
+	_, err = conn.Write(append(header, s.group...))
 	if err != nil {
 		return nil, err
 	}
@@ -475,31 +1292,33 @@ func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.
 	return conn, err
 }
 
-// Accept accepts incoming connections and reads the byte that identifies the conn(that we send in Dial()) and then creates a server-side TLS conn.
+// Accept accepts the incoming connections of the group and then creates a server-side TLS conn.
 func (s *StreamLayer) Accept() (net.Conn, error) {
-	conn, err := s.ln.Accept()
-	if err != nil {
-		return nil, err
-	}
-	b := make([]byte, 1)
-	_, err = conn.Read(b)
-	if err != nil {
-		return nil, err
-	}
-	if bytes.Compare([]byte{byte(RaftRPC)}, b) != 0 {
-		return nil, fmt.Errorf("not a raft rpc")
-	}
-	if s.serverTLSConfig != nil {
-		return tls.Server(conn, s.serverTLSConfig), nil
+	select {
+	case conn := <-s.conns:
+		if s.serverTLSConfig != nil {
+			return tls.Server(conn, s.serverTLSConfig), nil
+		}
+		return conn, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	case <-s.mux.done:
+		return nil, net.ErrClosed
 	}
-	return conn, nil
 }
 
-// Close closes the listener
+// Close stops accepting the group's conns. Closing the metadata group's layer closes the listener, and so every group's layer.
 func (s *StreamLayer) Close() error {
-	return s.ln.Close()
+	s.close.Do(func() {
+		close(s.done)
+		s.mux.remove(s)
+	})
+	if s.group == metadataGroup {
+		return s.mux.close()
+	}
+	return nil
 }
 
 func (s *StreamLayer) Addr() net.Addr {
-	return s.ln.Addr()
+	return s.mux.ln.Addr()
 }
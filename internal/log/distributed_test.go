@@ -1,10 +1,13 @@
 package log_test
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,6 +16,8 @@ import (
 	"github.com/innazh/proglog/internal/log"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestMultipleNodes(t *testing.T) {
@@ -50,7 +55,7 @@ func TestMultipleNodes(t *testing.T) {
 
 		if i != 0 {
 			err = logs[0].Join(
-				fmt.Sprintf("%d", i), ln.Addr().String(),
+				fmt.Sprintf("%d", i), ln.Addr().String(), true,
 			)
 			require.NoError(t, err)
 		} else {
@@ -84,6 +89,26 @@ func TestMultipleNodes(t *testing.T) {
 		}, 500*time.Millisecond, 50*time.Millisecond)
 	}
 
+	// a batch is replicated as a single command
+	batch := []*api.Record{
+		{Value: []byte("batch first")},
+		{Value: []byte("batch second")},
+	}
+	first, last, err := logs[0].AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, first+1, last)
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			for i, record := range batch {
+				got, err := logs[j].Read(first + uint64(i))
+				if err != nil || !reflect.DeepEqual(got.Value, record.Value) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
 	servers, err := logs[0].GetServers()
 	require.NoError(t, err)
 	require.Equal(t, 3, len(servers))
@@ -91,6 +116,46 @@ func TestMultipleNodes(t *testing.T) {
 	require.False(t, servers[1].IsLeader)
 	require.False(t, servers[2].IsLeader)
 
+	// a follower that's applied the index the leader handed out for a write can read it
+	off, index, err := logs[0].AppendIndexed(&api.Record{Value: []byte("read your writes")})
+	require.NoError(t, err)
+	require.Equal(t, logs[0].AppliedIndex(), index)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, logs[2].WaitApplied(ctx, index))
+	got, err := logs[2].Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("read your writes"), got.Value)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, logs[2].WaitApplied(ctx, index+100), context.DeadlineExceeded)
+
+	// followers point appends to the leader
+	_, err = logs[1].Append(&api.Record{Value: []byte("not here")})
+	require.Equal(t, api.ErrNotLeader{LeaderAddr: servers[0].RpcAddr}, err)
+
+	// and the reads that need to be more up to date than they can tell they are
+	require.NoError(t, logs[0].VerifyRead(api.ReadConsistency_READ_CONSISTENCY_LINEARIZABLE, 0, 0))
+	err = logs[1].VerifyRead(api.ReadConsistency_READ_CONSISTENCY_LINEARIZABLE, 0, 0)
+	require.Equal(t, api.ErrNotLeader{LeaderAddr: servers[0].RpcAddr}, err)
+	require.NoError(t, logs[1].VerifyRead(api.ReadConsistency_READ_CONSISTENCY_BOUNDED, 100, time.Minute))
+	err = logs[1].VerifyRead(api.ReadConsistency_READ_CONSISTENCY_BOUNDED, 0, time.Nanosecond)
+	require.Equal(t, api.ErrNotLeader{LeaderAddr: servers[0].RpcAddr}, err)
+	require.NoError(t, logs[0].VerifyRead(api.ReadConsistency_READ_CONSISTENCY_BOUNDED, 0, time.Nanosecond))
+
+	// a demoted server keeps its place in the configuration without a vote, joining it as a voter promotes it back
+	require.NoError(t, logs[0].Demote("2"))
+	require.NoError(t, logs[0].Join("2", servers[2].RpcAddr, false))
+	configuration, err := logs[0].GetConfiguration()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(configuration))
+	require.Equal(t, api.Suffrage_SUFFRAGE_NONVOTER, configuration[2].Suffrage)
+	require.NoError(t, logs[0].Join("2", servers[2].RpcAddr, true))
+	configuration, err = logs[0].GetConfiguration()
+	require.NoError(t, err)
+	require.Equal(t, api.Suffrage_SUFFRAGE_VOTER, configuration[2].Suffrage)
+	require.True(t, configuration[0].IsLeader)
+
 	err = logs[0].Leave("1")
 	require.NoError(t, err)
 
@@ -102,7 +167,7 @@ func TestMultipleNodes(t *testing.T) {
 	require.True(t, servers[0].IsLeader)
 	require.False(t, servers[1].IsLeader)
 
-	off, err := logs[0].Append(&api.Record{
+	off, err = logs[0].Append(&api.Record{
 		Value: []byte("third"),
 	})
 	require.NoError(t, err)
@@ -118,3 +183,761 @@ func TestMultipleNodes(t *testing.T) {
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset)
 }
+
+func TestBoundedReads(t *testing.T) {
+	var logs []*log.DistributedLog
+	var addrs []string
+	nodeCount := 2
+	ports := dynaport.Get(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := os.MkdirTemp("", "distributed-log-bounded-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = i == 0
+
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		}
+		logs = append(logs, l)
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	// the leader commits a lot of entries before the follower joins
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := logs[0].Append(&api.Record{Value: []byte("hello")})
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, logs[1].VerifyRead(api.ReadConsistency_READ_CONSISTENCY_BOUNDED, 10, 0))
+
+	// while it catches up, the follower knows how far behind the leader it is
+	require.NoError(t, logs[0].Join("1", addrs[1], false))
+	require.Eventually(t, func() bool {
+		err := logs[1].VerifyRead(api.ReadConsistency_READ_CONSISTENCY_BOUNDED, 10, 0)
+		return err == api.ErrNotLeader{LeaderAddr: addrs[0]}
+	}, 3*time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		return logs[1].VerifyRead(api.ReadConsistency_READ_CONSISTENCY_BOUNDED, 10, 0) == nil
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestRetention(t *testing.T) {
+	var logs []*log.DistributedLog
+	nodeCount := 3
+	ports := dynaport.Get(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := os.MkdirTemp("", "distributed-log-retention-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = i == 0
+		// two records per segment
+		config.Segment.MaxStoreBytes = 32
+		config.Retention.MaxRecords = 4
+		config.Retention.CheckInterval = 50 * time.Millisecond
+
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i != 0 {
+			err = logs[0].Join(
+				fmt.Sprintf("%d", i), ln.Addr().String(), true,
+			)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+
+		logs = append(logs, l)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := logs[0].Append(&api.Record{Value: []byte("hello")})
+		require.NoError(t, err)
+	}
+
+	// [0, 1] [2, 3] [4, 5] [6, 7] [8, 9] [] -> only the last two full segments fit in 4 records
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			lowest, err := l.LowestOffset()
+			require.NoError(t, err)
+			if lowest != 6 {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+
+	for _, l := range logs {
+		_, err := l.Read(5)
+		require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+		record, err := l.Read(9)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello"), record.Value)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	var logs []*log.DistributedLog
+	nodeCount := 2
+	ports := dynaport.Get(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := os.MkdirTemp("", "distributed-log-compaction-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = i == 0
+		// the servers' segments don't line up: the leader's are small, the follower's hold every record
+		if i == 0 {
+			config.Segment.MaxStoreBytes = 64
+		}
+		config.Compaction.Enabled = true
+		config.Compaction.Interval = 50 * time.Millisecond
+
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i != 0 {
+			err = logs[0].Join(
+				fmt.Sprintf("%d", i), ln.Addr().String(), true,
+			)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+
+		logs = append(logs, l)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := logs[0].Append(&api.Record{Key: []byte{byte('a' + i%2)}, Value: []byte(fmt.Sprintf("value %d", i))})
+		require.NoError(t, err)
+	}
+
+	// every server compacts the same records, whatever its segments look like
+	left := func(l *log.DistributedLog) (offsets []uint64) {
+		for off := uint64(0); off < 10; off++ {
+			if _, err := l.Read(off); err == nil {
+				offsets = append(offsets, off)
+			}
+		}
+		return offsets
+	}
+	require.Eventually(t, func() bool {
+		want := left(logs[0])
+		return len(want) < 5 && reflect.DeepEqual(want, left(logs[1]))
+	}, 3*time.Second, 50*time.Millisecond)
+
+	for _, l := range logs {
+		_, err := l.Read(0)
+		require.Contains(t, []error{api.ErrOffsetNotFound{Offset: 0}, api.ErrOffsetOutOfRange{Offset: 0}}, err)
+		// the newest records are never compacted away
+		for off := uint64(8); off < 10; off++ {
+			record, err := l.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("value %d", off), string(record.Value))
+		}
+	}
+}
+
+func TestDivergentLog(t *testing.T) {
+	var logs []*log.DistributedLog
+	nodeCount := 3
+	ports := dynaport.Get(nodeCount)
+	dirs := make([]string, nodeCount)
+
+	newNode := func(i int) *log.DistributedLog {
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = i == 0
+
+		l, err := log.NewDistributedLog(dirs[i], config)
+		require.NoError(t, err)
+		return l
+	}
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := os.MkdirTemp("", "distributed-log-divergence-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+		dirs[i] = dataDir
+
+		l := newNode(i)
+		if i != 0 {
+			err = logs[0].Join(fmt.Sprintf("%d", i), fmt.Sprintf("127.0.0.1:%d", ports[i]), true)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+		logs = append(logs, l)
+	}
+
+	replicated := func(off uint64, value []byte) func() bool {
+		return func() bool {
+			for _, l := range logs {
+				got, err := l.Read(off)
+				if err != nil || !reflect.DeepEqual(got.Value, value) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	for _, value := range []string{"first", "second"} {
+		off, err := logs[0].Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+		require.Eventually(t, replicated(off, []byte(value)), time.Second, 50*time.Millisecond)
+	}
+
+	// take a follower down and give its Raft log a tail that was never committed, from an older term
+	require.NoError(t, logs[2].Close())
+	raftLogConfig := log.Config{}
+	raftLogConfig.Segment.InitialOffset = 1
+	raftLog, err := log.NewLog(filepath.Join(dirs[2], "raft", "log"), raftLogConfig)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = raftLog.Append(&api.Record{
+			Value: []byte("uncommitted"),
+			Term:  1,
+			Type:  uint32(raft.LogCommand),
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, raftLog.Close())
+
+	// meanwhile the rest of the cluster moves on
+	for _, value := range []string{"third", "fourth"} {
+		_, err := logs[0].Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+
+	// once it's back, the follower has to drop its conflicting tail and take the leader's entries instead
+	logs[2] = newNode(2)
+	defer func() {
+		for _, l := range logs {
+			l.Close()
+		}
+	}()
+	for off, value := range []string{"first", "second", "third", "fourth"} {
+		require.Eventually(t, replicated(uint64(off), []byte(value)), 3*time.Second, 50*time.Millisecond)
+	}
+	_, err = logs[2].Read(4)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+func TestGroupCommit(t *testing.T) {
+	require.NoError(t, view.Register(log.GroupCommitViews...))
+	defer view.Unregister(log.GroupCommitViews...)
+
+	dataDir, err := os.MkdirTemp("", "distributed-log-group-commit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]))
+	require.NoError(t, err)
+
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID("0")
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.BindAddr = ln.Addr().String()
+	config.Raft.Bootstrap = true
+	config.GroupCommit.MaxDelay = 20 * time.Millisecond
+	config.GroupCommit.MaxRecords = 16
+
+	l, err := log.NewDistributedLog(dataDir, config)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+
+	const appends = 50
+	offsets := make([]uint64, appends)
+	indexes := make([]uint64, appends)
+	errs := make([]error, appends)
+	var wg sync.WaitGroup
+	for i := 0; i < appends; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			offsets[i], indexes[i], errs[i] = l.AppendIndexed(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		}(i)
+	}
+	wg.Wait()
+
+	// every caller got its own offset, pointing at its own record
+	seen := make(map[uint64]bool)
+	entries := make(map[uint64]bool) // the appends of a batch share the index of its Raft entry
+	for i, off := range offsets {
+		require.NoError(t, errs[i])
+		require.False(t, seen[off])
+		require.Less(t, off, uint64(appends))
+		seen[off] = true
+		require.NotZero(t, indexes[i])
+		entries[indexes[i]] = true
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+
+	rows, err := view.RetrieveData("proglog/group_commit/batch_records")
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	batches := rows[0].Data.(*view.DistributionData)
+	require.Equal(t, float64(appends), batches.Sum())
+	require.Less(t, batches.Count, int64(appends))
+	require.Equal(t, batches.Count, int64(len(entries)))
+	require.LessOrEqual(t, batches.Max, float64(16))
+}
+
+func TestTopics(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "distributed-log-topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	port := dynaport.Get(1)[0]
+
+	open := func() *log.DistributedLog {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID("0")
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = true
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		return l
+	}
+	l := open()
+
+	ordersConfig := &api.TopicConfig{MaxStoreBytes: 1 << 20, Partitions: 2}
+	require.NoError(t, l.CreateTopic("orders", ordersConfig))
+	require.NoError(t, l.CreateTopic("payments", nil))
+	require.Equal(t, api.ErrTopicExists{Topic: "orders"}, l.CreateTopic("orders", nil))
+	require.Error(t, l.CreateTopic("../escape", nil))
+	require.Error(t, l.CreateTopic("huge", &api.TopicConfig{Partitions: api.MaxPartitions + 1}))
+	_, err = l.Partition("missing", 0)
+	require.Equal(t, api.ErrTopicNotFound{Topic: "missing"}, err)
+	_, err = l.Partition("orders", 2)
+	require.Equal(t, api.ErrPartitionNotFound{Topic: "orders", Partition: 2}, err)
+	partitions, err := l.Partitions("orders")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), partitions)
+
+	// every partition is replicated by a Raft group of its own
+	orders, err := l.Partition("orders", 0)
+	require.NoError(t, err)
+	orders1, err := l.Partition("orders", 1)
+	require.NoError(t, err)
+	require.NotSame(t, orders, orders1)
+	require.NoError(t, orders.WaitForLeader(3*time.Second))
+	require.NoError(t, orders1.WaitForLeader(3*time.Second))
+	servers, err := l.GetServers()
+	require.NoError(t, err)
+	require.Len(t, servers[0].Partitions, 4) // the default topic's, the 2 of orders and the one of payments
+	for _, partition := range servers[0].Partitions {
+		if partition.Topic != "payments" {
+			require.True(t, partition.IsLeader, partition.Topic)
+		}
+	}
+
+	// every partition of every topic has offsets of its own
+	for i := 0; i < 3; i++ {
+		off, err := orders.Append(&api.Record{Value: []byte(fmt.Sprintf("order %d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	off, err := orders1.Append(&api.Record{Value: []byte("order 1/0")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	off, err = l.Append(&api.Record{Value: []byte("default")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	record, err := orders.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order 0"), record.Value)
+
+	require.NoError(t, l.DeleteTopic("payments"))
+	require.Equal(t, api.ErrTopicNotFound{Topic: "payments"}, l.DeleteTopic("payments"))
+	require.Error(t, l.DeleteTopic(""))
+
+	// the topics survive a restart through the snapshot, and the entries applied after it
+	_, err = l.Snapshot()
+	require.NoError(t, err)
+	require.NoError(t, l.CreateTopic("refunds", nil))
+	_, err = orders.Append(&api.Record{Value: []byte("order 3")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	l = open()
+	defer l.Close()
+	require.Eventually(t, func() bool {
+		return len(l.ListTopics()) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, "orders", l.ListTopics()[0].Name)
+	require.True(t, proto.Equal(ordersConfig, l.ListTopics()[0].Config))
+	require.Equal(t, "refunds", l.ListTopics()[1].Name)
+	orders, err = l.Partition("orders", 0)
+	require.NoError(t, err)
+	require.NoError(t, orders.WaitForLeader(3*time.Second))
+	require.Eventually(t, func() bool {
+		next, err := orders.NextOffset()
+		return err == nil && next == 4
+	}, 3*time.Second, 50*time.Millisecond)
+	record, err = orders.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order 3"), record.Value)
+	orders1, err = l.Partition("orders", 1)
+	require.NoError(t, err)
+	record, err = orders1.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order 1/0"), record.Value)
+	record, err = l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("default"), record.Value)
+}
+
+func TestPartitionGroups(t *testing.T) {
+	var logs []*log.DistributedLog
+	nodeCount := 3
+	ports := dynaport.Get(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := os.MkdirTemp("", "distributed-log-groups-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Groups.ReconcileInterval = 50 * time.Millisecond
+		if i == 0 {
+			config.Raft.Bootstrap = true
+		}
+
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+			// the topic's groups start out with the only server there is, the others are added to them as they join
+			require.NoError(t, l.CreateTopic("orders", &api.TopicConfig{Partitions: 3}))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String(), true))
+		}
+		logs = append(logs, l)
+	}
+
+	// every server ends up in every group, and the groups' leadership is spread over the servers
+	leaders := make(map[uint32]int)
+	require.Eventually(t, func() bool {
+		servers, err := logs[0].GetServers()
+		if err != nil || len(servers) != nodeCount {
+			return false
+		}
+		clear(leaders)
+		for i, server := range servers {
+			if len(server.Partitions) != 4 {
+				return false
+			}
+			for _, partition := range server.Partitions {
+				if partition.Topic == "orders" && partition.IsLeader {
+					leaders[partition.Id] = i
+				}
+			}
+		}
+		return len(leaders) == 3 && leaders[0] != leaders[1] && leaders[1] != leaders[2] && leaders[0] != leaders[2]
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// a partition takes writes on its group's leader only, and they're replicated to the rest of the group
+	for p := uint32(0); p < 3; p++ {
+		leader, err := logs[leaders[p]].Partition("orders", p)
+		require.NoError(t, err)
+		record := &api.Record{Value: []byte(fmt.Sprintf("order on %d", p))}
+		off, err := leader.Append(record)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+
+		follower, err := logs[(leaders[p]+1)%nodeCount].Partition("orders", p)
+		require.NoError(t, err)
+		_, err = follower.Append(record)
+		require.IsType(t, api.ErrNotLeader{}, err)
+
+		require.Eventually(t, func() bool {
+			for _, l := range logs {
+				partition, err := l.Partition("orders", p)
+				if err != nil {
+					return false
+				}
+				got, err := partition.Read(off)
+				if err != nil || !reflect.DeepEqual(got.Value, record.Value) {
+					return false
+				}
+			}
+			return true
+		}, 3*time.Second, 50*time.Millisecond)
+	}
+}
+
+func TestIdempotentProducers(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "distributed-log-producers-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	port := dynaport.Get(1)[0]
+
+	open := func() *log.DistributedLog {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID("0")
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = true
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		return l
+	}
+	l := open()
+
+	first, err := l.InitProducer()
+	require.NoError(t, err)
+	second, err := l.InitProducer()
+	require.NoError(t, err)
+	require.NotZero(t, first)
+	require.NotEqual(t, first, second)
+
+	record := func(value string) []*api.Record {
+		return []*api.Record{{Value: []byte(value)}}
+	}
+	off, _, _, err := l.AppendIdempotent(first, 0, record("payment 0"))
+	require.NoError(t, err)
+
+	// a retry gets the offset the record got the first time, and isn't appended again
+	retry, _, _, err := l.AppendIdempotent(first, 0, record("payment 0"))
+	require.NoError(t, err)
+	require.Equal(t, off, retry)
+	next, err := l.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, off+1, next)
+
+	// batches too, their records take consecutive sequence nums
+	batch := []*api.Record{{Value: []byte("payment 1")}, {Value: []byte("payment 2")}}
+	batchFirst, batchLast, _, err := l.AppendIdempotent(first, 1, batch)
+	require.NoError(t, err)
+	require.Equal(t, off+1, batchFirst)
+	retryFirst, retryLast, _, err := l.AppendIdempotent(first, 1, batch)
+	require.NoError(t, err)
+	require.Equal(t, batchFirst, retryFirst)
+	require.Equal(t, batchLast, retryLast)
+
+	// so do the retries of the batches before the last one, which the producer may have had in flight along with it
+	retry, _, _, err = l.AppendIdempotent(first, 0, record("payment 0"))
+	require.NoError(t, err)
+	require.Equal(t, off, retry)
+
+	// records have to follow the last ones, whether there's a gap or they're older
+	_, _, _, err = l.AppendIdempotent(first, 5, record("payment 5"))
+	require.Equal(t, api.ErrOutOfOrderSequence{ProducerID: first, Expected: 3, Sequence: 5}, err)
+	_, _, _, err = l.AppendIdempotent(first, 1, record("payment 1"))
+	require.Equal(t, api.ErrOutOfOrderSequence{ProducerID: first, Expected: 3, Sequence: 1}, err)
+
+	// every producer has sequence nums of its own
+	other, _, _, err := l.AppendIdempotent(second, 0, record("refund 0"))
+	require.NoError(t, err)
+	require.Equal(t, batchLast+1, other)
+
+	// the producers survive a restart through the snapshot, and the entries applied after it
+	_, err = l.Snapshot()
+	require.NoError(t, err)
+	_, _, _, err = l.AppendIdempotent(second, 1, record("refund 1"))
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	l = open()
+	defer l.Close()
+	retryFirst, retryLast, _, err = l.AppendIdempotent(first, 1, batch)
+	require.NoError(t, err)
+	require.Equal(t, batchFirst, retryFirst)
+	require.Equal(t, batchLast, retryLast)
+	retry, _, _, err = l.AppendIdempotent(second, 1, record("refund 1"))
+	require.NoError(t, err)
+	require.Equal(t, other+1, retry)
+	third, err := l.InitProducer()
+	require.NoError(t, err)
+	require.Greater(t, third, second)
+
+	// only the latest batches are remembered
+	for seq := uint64(3); seq < 8; seq++ {
+		_, _, _, err = l.AppendIdempotent(first, seq, record(fmt.Sprintf("payment %d", seq)))
+		require.NoError(t, err)
+	}
+	_, _, _, err = l.AppendIdempotent(first, 1, batch)
+	require.Equal(t, api.ErrOutOfOrderSequence{ProducerID: first, Expected: 8, Sequence: 1}, err)
+	retry, _, _, err = l.AppendIdempotent(first, 3, record("payment 3"))
+	require.NoError(t, err)
+	require.Equal(t, batchLast+3, retry)
+}
+
+func TestRestart(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "distributed-log-restart-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	port := dynaport.Get(1)[0]
+
+	open := func() *log.DistributedLog {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID("0")
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = true
+		config.Segment.MaxStoreBytes = 64
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		return l
+	}
+	var values []string
+	appendValues := func(l *log.DistributedLog, n int) {
+		for i := 0; i < n; i++ {
+			value := fmt.Sprintf("record %d", len(values))
+			off, err := l.Append(&api.Record{Value: []byte(value)})
+			require.NoError(t, err)
+			require.Equal(t, uint64(len(values)), off)
+			values = append(values, value)
+		}
+	}
+	// every record is there once, at the offset it got the first time
+	check := func(l *log.DistributedLog) {
+		require.Eventually(t, func() bool {
+			next, err := l.NextOffset()
+			require.NoError(t, err)
+			return next == uint64(len(values))
+		}, 3*time.Second, 50*time.Millisecond)
+		for off, value := range values {
+			record, err := l.Read(uint64(off))
+			require.NoError(t, err)
+			require.Equal(t, value, string(record.Value))
+		}
+	}
+
+	// without a snapshot, the records come back from Raft's log
+	l := open()
+	appendValues(l, 5)
+	require.NoError(t, l.Close())
+	l = open()
+	check(l)
+
+	// with one, the records it has are kept as they are, the ones after it come back from Raft's log
+	_, err = l.Snapshot()
+	require.NoError(t, err)
+	appendValues(l, 3)
+	before, err := os.Stat(filepath.Join(dataDir, "log", "0.store"))
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	l = open()
+	defer l.Close()
+	check(l)
+	after, err := os.Stat(filepath.Join(dataDir, "log", "0.store"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before, after))
+	appendValues(l, 1)
+}
@@ -0,0 +1,205 @@
+package log
+
+import (
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	api "github.com/innazh/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// metadataGroup is the Raft group every server starts with, it replicates the topics and the default topic's records
+const metadataGroup = ""
+
+// groupName names the Raft group of a topic's partition. The topic's id tells it apart from the topics that had the same name before it.
+func groupName(topic string, topicID uint64, partition uint32) string {
+	return fmt.Sprintf("%s/%d/%d", topic, topicID, partition)
+}
+
+// handshakeTimeout bounds how long the stream mux waits for a conn to tell which group it's for
+const handshakeTimeout = 10 * time.Second
+
+/*
+streamMux accepts the Raft conns of every group from the listener, and hands them over to the stream layer of the group they're for.
+The conns for a group the server doesn't have (yet) are closed, Raft dials them again later.
+*/
+type streamMux struct {
+	ln        net.Listener
+	done      chan struct{} // closed along with the listener
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	layers map[string]*StreamLayer // by group
+}
+
+func newStreamMux(ln net.Listener) *streamMux {
+	m := &streamMux{
+		ln:     ln,
+		done:   make(chan struct{}),
+		layers: make(map[string]*StreamLayer),
+	}
+	go m.serve()
+	return m
+}
+
+// layer creates the stream layer of the group, it replaces the one the group had before if it wasn't closed
+func (m *streamMux) layer(group string, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
+	s := &StreamLayer{
+		mux:             m,
+		group:           group,
+		conns:           make(chan net.Conn),
+		done:            make(chan struct{}),
+		serverTLSConfig: serverTLSConfig, // secure server-to-server communication
+		peerTLSConfig:   peerTLSConfig,   //secure outgoing conns
+	}
+	m.mu.Lock()
+	m.layers[group] = s
+	m.mu.Unlock()
+	return s
+}
+
+// remove forgets the layer, unless the group has got another one since
+func (m *streamMux) remove(s *StreamLayer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.layers[s.group] == s {
+		delete(m.layers, s.group)
+	}
+}
+
+func (m *streamMux) serve() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			_ = m.close()
+			return
+		}
+		go m.handshake(conn)
+	}
+}
+
+// handshake reads the header Dial starts the conn with and hands the conn over to its group's layer
+func (m *streamMux) handshake(conn net.Conn) {
+	header := make([]byte, 3)
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != byte(RaftRPC) {
+		_ = conn.Close()
+		return
+	}
+	group := make([]byte, enc.Uint16(header[1:]))
+	if _, err := io.ReadFull(conn, group); err != nil {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	m.mu.Lock()
+	s, ok := m.layers[string(group)]
+	m.mu.Unlock()
+	if !ok {
+		_ = conn.Close()
+		return
+	}
+	select {
+	case s.conns <- conn:
+	case <-s.done:
+		_ = conn.Close()
+	case <-m.done:
+		_ = conn.Close()
+	}
+}
+
+func (m *streamMux) close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		err = m.ln.Close()
+	})
+	return err
+}
+
+// spread is where the leadership of a topic's partition goes among the voters, the partitions of a topic go to consecutive ones
+func spread(topic string, partition uint32) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return h.Sum32() + partition
+}
+
+/*
+follow keeps the group of a topic's partition in line with the metadata group while this server leads it, until the log is closed.
+The servers the metadata group adds and removes, e.g. through discovery, are added to and removed from the group with the same suffrage.
+Leadership is handed over to the voter the partition is spread to, so the groups' leaders, and the writes they take, are spread
+over the servers.
+*/
+func (l *DistributedLog) follow(metadata *DistributedLog, spread uint32) {
+	defer l.wg.Done()
+	// the partitions' groups are opened while the metadata group restores its snapshot, before it's all set up
+	select {
+	case <-metadata.ready:
+	case <-l.closed:
+		return
+	}
+	interval := l.config.Groups.ReconcileInterval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-ticker.C:
+		case <-l.raft.LeaderCh():
+		}
+		if l.raft.State() != raft.Leader {
+			continue
+		}
+		err := l.reconcile(metadata, spread)
+		if _, notLeader := err.(api.ErrNotLeader); err != nil && !notLeader {
+			zap.L().Named("group").Error("failed to reconcile the partition's group", zap.Error(err))
+		}
+	}
+}
+
+// reconcile brings the group's servers in line with the metadata group's, then hands leadership over if it's meant to be elsewhere
+func (l *DistributedLog) reconcile(metadata *DistributedLog, spread uint32) error {
+	want := metadata.raft.GetConfiguration().Configuration().Servers
+	for _, srv := range want {
+		if err := l.Join(string(srv.ID), string(srv.Address), srv.Suffrage != raft.Nonvoter); err != nil {
+			return err
+		}
+	}
+	servers := l.raft.GetConfiguration().Configuration().Servers
+	for _, srv := range servers {
+		if !slices.ContainsFunc(want, func(w raft.Server) bool { return w.ID == srv.ID }) {
+			if err := l.Leave(string(srv.ID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	var voters []raft.Server
+	for _, srv := range l.raft.GetConfiguration().Configuration().Servers {
+		if srv.Suffrage == raft.Voter {
+			voters = append(voters, srv)
+		}
+	}
+	if len(voters) == 0 {
+		return nil
+	}
+	slices.SortFunc(voters, func(a, b raft.Server) int { return strings.Compare(string(a.ID), string(b.ID)) })
+	leader := voters[spread%uint32(len(voters))]
+	if leader.ID == l.config.Raft.LocalID {
+		return nil
+	}
+	return l.leaderErr(l.raft.LeadershipTransferToServer(leader.ID, leader.Address).Error())
+}
@@ -0,0 +1,152 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	api "github.com/innazh/proglog/api/v1"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/protobuf/proto"
+)
+
+var errLogClosed = errors.New("log: closed")
+
+// Group commit metrics, recorded once per committed batch and once per append respectively
+var (
+	groupCommitRecords = stats.Int64("proglog/group_commit/batch_records", "Num of records committed in a single Raft command", stats.UnitDimensionless)
+	groupCommitBytes   = stats.Int64("proglog/group_commit/batch_bytes", "Size of the records committed in a single Raft command", stats.UnitBytes)
+	groupCommitLatency = stats.Float64("proglog/group_commit/latency", "Time from an append being queued until its batch is committed", stats.UnitMilliseconds)
+)
+
+// GroupCommitViews are the views of the group commit metrics, they have to be registered with view.Register to be exported
+var GroupCommitViews = []*view.View{
+	{
+		Name:        "proglog/group_commit/batch_records",
+		Measure:     groupCommitRecords,
+		Description: "Distribution of the num of records per group commit",
+		Aggregation: view.Distribution(1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024, 2048),
+	},
+	{
+		Name:        "proglog/group_commit/batch_bytes",
+		Measure:     groupCommitBytes,
+		Description: "Distribution of the size of the group commits",
+		Aggregation: view.Distribution(1<<10, 4<<10, 16<<10, 64<<10, 256<<10, 1<<20, 4<<20),
+	},
+	{
+		Name:        "proglog/group_commit/latency",
+		Measure:     groupCommitLatency,
+		Description: "Distribution of the time appends spend waiting for their group commit",
+		Aggregation: view.Distribution(0.5, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000),
+	},
+}
+
+// pendingAppend is an append waiting for its batch to be committed
+type pendingAppend struct {
+	record *api.Record
+	queued time.Time
+	done   chan appendResult
+}
+
+type appendResult struct {
+	offset uint64
+	index  uint64 // of the Raft entry the batch was committed with
+	err    error
+}
+
+/*
+batcher collects the appends made through DistributedLog.Append and commits them together with a single Raft command.
+A batch is started by the first append that arrives and is committed once GroupCommit.MaxDelay has passed,
+or as soon as it reaches GroupCommit.MaxRecords or GroupCommit.MaxBytes. Batches are committed one at a time,
+so the appends that arrive while a batch is being replicated make up the next one.
+*/
+type batcher struct {
+	commit     func(records []*api.Record) (first, last, index uint64, err error)
+	maxDelay   time.Duration
+	maxRecords int
+	maxBytes   int
+
+	appends chan *pendingAppend
+	closed  <-chan struct{}
+}
+
+func newBatcher(c Config, closed <-chan struct{}, commit func([]*api.Record) (uint64, uint64, uint64, error)) *batcher {
+	b := &batcher{
+		commit:     commit,
+		maxDelay:   c.GroupCommit.MaxDelay,
+		maxRecords: c.GroupCommit.MaxRecords,
+		maxBytes:   c.GroupCommit.MaxBytes,
+		appends:    make(chan *pendingAppend),
+		closed:     closed,
+	}
+	if b.maxRecords == 0 {
+		b.maxRecords = 1000
+	}
+	if b.maxBytes == 0 {
+		b.maxBytes = 1 << 20
+	}
+	return b
+}
+
+// append queues the record for the next batch and waits until it's committed, it returns the record's offset and the batch's index
+func (b *batcher) append(record *api.Record) (uint64, uint64, error) {
+	p := &pendingAppend{record: record, queued: time.Now(), done: make(chan appendResult, 1)}
+	select {
+	case b.appends <- p:
+	case <-b.closed:
+		return 0, 0, errLogClosed
+	}
+	// every append the batcher took in gets an answer, even when it's closed in the meantime
+	res := <-p.done
+	return res.offset, res.index, res.err
+}
+
+// run collects and commits batches until closed, the batch being collected at the time is still committed
+func (b *batcher) run() {
+	for {
+		var p *pendingAppend
+		select {
+		case <-b.closed:
+			return
+		case p = <-b.appends:
+		}
+		batch := []*pendingAppend{p}
+		size := proto.Size(p.record)
+
+		timer := time.NewTimer(b.maxDelay)
+	collect:
+		for len(batch) < b.maxRecords && size < b.maxBytes {
+			select {
+			case p = <-b.appends:
+				batch = append(batch, p)
+				size += proto.Size(p.record)
+			case <-timer.C:
+				break collect
+			case <-b.closed:
+				break collect
+			}
+		}
+		timer.Stop()
+		b.flush(batch, size)
+	}
+}
+
+// flush commits the batch and hands every append its offset, or the error that failed the whole batch
+func (b *batcher) flush(batch []*pendingAppend, size int) {
+	records := make([]*api.Record, len(batch))
+	for i, p := range batch {
+		records[i] = p.record
+	}
+	first, _, index, err := b.commit(records)
+	now := time.Now()
+	for i, p := range batch {
+		if err != nil {
+			p.done <- appendResult{err: err}
+		} else {
+			p.done <- appendResult{offset: first + uint64(i), index: index}
+		}
+		stats.Record(context.Background(), groupCommitLatency.M(float64(now.Sub(p.queued))/float64(time.Millisecond)))
+	}
+	stats.Record(context.Background(), groupCommitRecords.M(int64(len(batch))), groupCommitBytes.M(int64(size)))
+}
@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -20,11 +21,16 @@ type index struct {
 	file *os.File
 	mmap gommap.MMap
 	size uint64 //the size of the index and the starting point of the next index entry
+
+	syncOnWrite bool // msync every written entry
 }
 
 // newIndex creates an index for the given file. Once max index size is reached, we memory-map the file and return the index to the caller.
 func newIndex(f *os.File, c Config) (*index, error) {
-	idx := &index{file: f}
+	idx := &index{
+		file:        f,
+		syncOnWrite: c.Segment.Sync == SyncAlways,
+	}
 
 	fi, err := os.Stat(f.Name())
 	if err != nil {
@@ -82,6 +88,25 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// find returns the num of the first entry whose offset is at or after off, or io.EOF if there's none.
+// Entries are only sparse in compacted segments, everywhere else the entry of offset n is the n-th one.
+func (i *index) find(off uint32) (int64, error) {
+	entries := i.size / entWidth
+	if uint64(off) < entries {
+		if out, _, err := i.Read(int64(off)); err == nil && out == off {
+			return int64(off), nil
+		}
+	}
+	n := sort.Search(int(entries), func(in int) bool {
+		out, _, _ := i.Read(int64(in))
+		return out >= off
+	})
+	if uint64(n) == entries {
+		return 0, io.EOF
+	}
+	return int64(n), nil
+}
+
 func (i *index) Write(off uint32, pos uint64) error {
 	if i.isMaxed() {
 		return io.EOF
@@ -89,9 +114,17 @@ func (i *index) Write(off uint32, pos uint64) error {
 	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
 	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
 	i.size += uint64(entWidth)
+	if i.syncOnWrite {
+		return i.Sync()
+	}
 	return nil
 }
 
+// Sync flushes the memory-mapped entries to the index file
+func (i *index) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
 func (i *index) isMaxed() bool {
 	return uint64(len(i.mmap)) < i.size+entWidth
 }
@@ -1,6 +1,9 @@
 package log
 
 import (
+	"context"
+	"errors"
+	"hash/crc32"
 	"io"
 	"os"
 	"path"
@@ -8,8 +11,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/innazh/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 )
 
 // Log implements CommitLog interface
@@ -21,6 +27,15 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+	repairs       []Repair
+
+	closed chan struct{} // closed along with the log to stop its background goroutines
+	wg     sync.WaitGroup
+
+	rewriteMu sync.Mutex    // only one compaction or compression rewrites segments at a time
+	rolled    chan struct{} // signals the compression loop that a segment is no longer active
+
+	appended chan struct{} // closed and replaced every time records are appended, to wake up the callers of Wait
 }
 
 // NewLog sets the defaults for the config if aren't specified, creates and sets up Log
@@ -31,27 +46,54 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.SyncInterval == 0 {
+		c.Segment.SyncInterval = time.Second
+	}
+	if c.Segment.TimeIndexInterval == 0 {
+		c.Segment.TimeIndexInterval = 32
+	}
+	if c.Compaction.Interval == 0 {
+		c.Compaction.Interval = time.Minute
+	}
+	if c.Compression.BlockSize == 0 {
+		c.Compression.BlockSize = 64 * 1024
+	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:      dir,
+		Config:   c,
+		appended: make(chan struct{}),
 	}
 	return l, l.setup()
 }
 
-// setup is responsible for setting log up with the segments that already exist on disk (if any), or bootstrapping the initial segment
+// setup is responsible for setting log up with the segments that already exist on disk (if any), or bootstrapping the initial segment.
+// The existing segments are validated on open and repaired if the process died in the middle of writing or compacting them,
+// only the last one gets its records checked, see segment.recover.
 func (l *Log) setup() error {
+	if err := l.finishRewrites(); err != nil {
+		return err
+	}
 	files, err := os.ReadDir(l.Dir)
 	if err != nil {
 		return err
 	}
 	var baseOffsets []uint64 //base offsets of the existing segments (if any)
+	seen := make(map[uint64]bool)
 	for _, file := range files {
-		offStr := strings.TrimSuffix( //removes file extension from its full name
-			file.Name(),
-			path.Ext(file.Name()), //get file's extension
-		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
+		ext := path.Ext(file.Name()) //get file's extension
+		if file.IsDir() || (ext != ".store" && ext != compressedExt && ext != ".index" && ext != ".timeindex") {
+			continue
+		}
+		offStr := strings.TrimSuffix(file.Name(), ext) //removes file extension from its full name
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
+		// every segment has a store and two index files, we only need its base offset once
+		if !seen[off] {
+			seen[off] = true
+			baseOffsets = append(baseOffsets, off)
+		}
 	}
 
 	// we want our segments to be in order from oldest to newest
@@ -59,13 +101,26 @@ func (l *Log) setup() error {
 		return baseOffsets[i] < baseOffsets[j]
 	})
 
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	l.repairs = nil
+	for i, baseOffset := range baseOffsets {
+		if err = l.newSegment(baseOffset); err != nil {
+			return err
+		}
+		repair, err := l.activeSegment.recover(i == len(baseOffsets)-1)
+		if err != nil {
 			return err
 		}
-		// baseOffset contains dup for index and store so we skip
-		// the dup
-		i++
+		if repair != nil {
+			zap.L().Named("log").Warn(
+				"repaired segment",
+				zap.String("dir", l.Dir),
+				zap.Uint64("base_offset", repair.BaseOffset),
+				zap.Uint64("store_bytes_dropped", repair.StoreBytesDropped),
+				zap.Uint64("index_entries_dropped", repair.IndexEntriesDropped),
+				zap.Uint64("time_index_entries_dropped", repair.TimeIndexEntriesDropped),
+			)
+			l.repairs = append(l.repairs, *repair)
+		}
 	}
 	if l.segments == nil {
 		if err = l.newSegment(
@@ -74,10 +129,53 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+
+	l.closed = make(chan struct{})
+	if l.Config.Segment.Sync == SyncPeriodic {
+		l.wg.Add(1)
+		go l.syncLoop(l.closed)
+	}
+	if l.Config.Compaction.Enabled {
+		l.wg.Add(1)
+		go l.compactLoop(l.closed)
+	}
+	if l.Config.Compression.Codec != nil {
+		l.rolled = make(chan struct{}, 1)
+		l.wg.Add(1)
+		go l.compressLoop(l.closed, l.rolled)
+	}
 	return nil
 }
 
+// syncLoop periodically commits the active segment to stable storage until the log is closed
+func (l *Log) syncLoop(closed <-chan struct{}) {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.Config.Segment.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			l.mu.RLock()
+			err := l.activeSegment.Sync()
+			l.mu.RUnlock()
+			if err != nil {
+				zap.L().Named("log").Error("failed to sync segment", zap.String("dir", l.Dir), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Repairs reports what setup had to cut off the segments it found on disk to bring them back to a consistent state
+func (l *Log) Repairs() []Repair {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.repairs
+}
+
 // Append is responsible for appending new records to the log in the current active segment. Creates a new segment if the curreng one gets maxed out.
+// The record's offset is set to the one it gets, see segment.Append for its append time.
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -86,32 +184,239 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+	l.notifyAppended()
+	return off, l.roll(off)
+}
+
+var errEmptyBatch = errors.New("log: empty batch")
+
+/*
+AppendBatch appends the records one after another under a single lock, so they get consecutive offsets.
+It's all or nothing: if one of the records can't be appended, the ones before it are removed again.
+Returns the offsets of the first and the last record.
+*/
+func (l *Log) AppendBatch(records []*api.Record) (first, last uint64, err error) {
+	if len(records) == 0 {
+		return 0, 0, errEmptyBatch
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	first = l.activeSegment.nextOffset
+	for _, record := range records {
+		if last, err = l.activeSegment.Append(record); err == nil {
+			err = l.roll(last)
+		}
+		if err != nil {
+			if rerr := l.truncateFrom(first); rerr != nil {
+				return 0, 0, rerr
+			}
+			return 0, 0, err
+		}
+	}
+	l.notifyAppended()
+	return first, last, nil
+}
+
+// appendAt appends the record at its own offset rather than the next one, see segment.appendAt
+func (l *Log) appendAt(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	off, err := l.activeSegment.appendAt(record)
+	if err != nil {
+		return 0, err
+	}
+	l.notifyAppended()
+	return off, l.roll(off)
+}
+
+// notifyAppended wakes up the callers of Wait. The caller must hold the lock.
+func (l *Log) notifyAppended() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+/*
+Wait blocks until the log has a record at off or after it, so readers tailing the log don't have to poll it.
+It returns right away if there already is one (or the offset was truncated away), and ctx's error if ctx is done first.
+*/
+func (l *Log) Wait(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		next := l.segments[len(l.segments)-1].nextOffset
+		appended := l.appended
+		l.mu.RUnlock()
+		if off < next {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// roll creates a new active segment after off if the current one got maxed out
+func (l *Log) roll(off uint64) error {
+	if !l.activeSegment.IsMaxed() {
+		return nil
+	}
+	return l.rollOver(off + 1)
+}
+
+// rollBefore creates a new active segment if the current one has records below off, so they can be compacted
+func (l *Log) rollBefore(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.activeSegment
+	if s.baseOffset >= off || s.nextOffset == s.baseOffset {
+		return nil
+	}
+	return l.rollOver(s.nextOffset)
+}
+
+// skipTo makes off the offset the next record gets, if the log is behind it, e.g. because compaction removed the records before it
+func (l *Log) skipTo(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.activeSegment
+	if s.nextOffset >= off {
+		return nil
+	}
+	if s.nextOffset > s.baseOffset {
+		return l.rollOver(off)
+	}
+	// the empty segment would be left behind in the middle of the log
+	if err := s.Remove(); err != nil {
+		return err
+	}
+	l.segments = l.segments[:len(l.segments)-1]
+	return l.newSegment(off)
+}
+
+// rollback cuts the log back to the records it had when next was the offset of the next record
+func (l *Log) rollback(next uint64) error {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	if cur, err := l.NextOffset(); err != nil || cur == next {
+		return err
+	}
+	if next <= lowest {
+		l.Config.Segment.InitialOffset = next
+		return l.Reset()
+	}
+	if err = l.TruncateAfter(next - 1); err != nil {
+		return err
+	}
+	return l.skipTo(next)
+}
+
+// rollOver creates a new active segment starting at off. The caller must hold the lock.
+func (l *Log) rollOver(off uint64) error {
+	// the segment won't be synced by the interval loop anymore once it's no longer active
+	if l.Config.Segment.Sync == SyncOnRoll || l.Config.Segment.Sync == SyncPeriodic {
+		if err := l.activeSegment.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := l.newSegment(off); err != nil {
+		return err
+	}
+	if l.rolled != nil {
+		select {
+		case l.rolled <- struct{}{}:
+		default: // the compression loop has yet to pick up the last one
+		}
 	}
-	return off, err
+	return nil
 }
 
 // Read reads the record stored in the given offset. It does so by first finding the right segment to read from.
+// Compaction leaves gaps in the log: reading an offset whose record was compacted away returns api.ErrOffsetNotFound.
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	return l.read(off, true)
+}
+
+/*
+ReadBatch reads the records from off on, as long as there are up to maxRecords of them and they add up to at most maxBytes
+(their encoded size). Zero means no limit. It always returns at least one record, or the error Read would have returned.
+Unlike Read, it's meant for consuming the log, so it skips the gaps left by compaction: if the record at off was compacted away,
+the batch starts with the next record after it.
+*/
+func (l *Log) ReadBatch(off uint64, maxRecords int, maxBytes uint64) ([]*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	record, err := l.read(off, false)
+	if err != nil {
+		return nil, err
+	}
+	records := []*api.Record{record}
+	size := uint64(proto.Size(record))
+	for maxRecords == 0 || len(records) < maxRecords {
+		record, err = l.read(record.Offset+1, false)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			break // we've read up to the end of the log
+		}
+		if err != nil {
+			return nil, err
+		}
+		size += uint64(proto.Size(record))
+		if maxBytes > 0 && size > maxBytes {
+			break
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// VerifyRead always succeeds, a log on its own is as up to date as it gets whatever the consistency asked for
+func (l *Log) VerifyRead(api.ReadConsistency, uint64, time.Duration) error {
+	return nil
+}
 
+// WaitApplied returns right away, a log on its own has nothing to apply
+func (l *Log) WaitApplied(context.Context, uint64) error {
+	return nil
+}
+
+// read reads the record at off. Unless exact, it reads the next one if it was compacted away. The caller must hold the read lock.
+func (l *Log) read(off uint64, exact bool) (*api.Record, error) {
 	var s *segment
 	for _, segment := range l.segments { //note: segments are already ordered from oldest to newest
-		if segment.baseOffset <= off && off < segment.nextOffset {
+		if off < segment.nextOffset && segment.baseOffset < segment.nextOffset {
 			s = segment
+			break
 		}
 	}
 
-	if s == nil || s.nextOffset <= off {
+	// offsets before the first segment were truncated away
+	if s == nil || off < l.segments[0].baseOffset {
 		return nil, api.ErrOffsetOutOfRange{Offset: off}
 	}
-	return s.Read(off)
+	if off < s.baseOffset {
+		// compaction removed the records at the end of the segment before
+		if exact {
+			return nil, api.ErrOffsetNotFound{Offset: off}
+		}
+		off = s.baseOffset
+	}
+	if exact {
+		return s.Read(off)
+	}
+	return s.readFrom(off)
 }
 
-// Close closes all segments
+// Close stops the background goroutines and closes all segments
 func (l *Log) Close() error {
+	l.stopBackground()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
@@ -123,6 +428,18 @@ func (l *Log) Close() error {
 	return nil
 }
 
+// stopBackground signals the background goroutines to stop and waits for them to return.
+// It must be called without holding the lock, since the goroutines take it themselves.
+func (l *Log) stopBackground() {
+	l.mu.Lock()
+	if l.closed != nil {
+		close(l.closed)
+		l.closed = nil
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+}
+
 // Remove closes the log and removes its data
 func (l *Log) Remove() error {
 	if err := l.Close(); err != nil {
@@ -136,9 +453,31 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments = nil
 	return l.setup()
 }
 
+// OffsetForTime returns the offset of the first record appended at or after ts (unix nanoseconds).
+// If there's no such record yet, it returns the offset the next appended record will get.
+func (l *Log) OffsetForTime(ts int64) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, s := range l.segments {
+		off, ok, err := s.OffsetForTime(ts)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return off, nil
+		}
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
 // The following methods tell us the offset range stored in the log
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
@@ -153,6 +492,13 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return l.highestOffset()
 }
 
+// NextOffset returns the offset the next appended record will get, which is the lowest offset if the log is empty
+func (l *Log) NextOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.segments[len(l.segments)-1].nextOffset, nil
+}
+
 func (l *Log) highestOffset() (uint64, error) {
 	off := l.segments[len(l.segments)-1].nextOffset
 	if off == 0 {
@@ -163,14 +509,46 @@ func (l *Log) highestOffset() (uint64, error) {
 
 /*
 Truncate is responsible for truncating/removing the old segments. This is done to periodically cleanup the space, since it's finite.
-All segments with offset lower than lowest will be removed
+All segments with offset lower than lowest will be removed, except for the active segment: the log always keeps it to append to,
+so truncating past the highest offset leaves the records of the active segment in place.
 */
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		// the active segment is always kept so the log has somewhere to append to
+		if s != l.activeSegment && s.nextOffset <= lowest+1 {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	return nil
+}
+
+/*
+TruncateAfter removes all the records after off, the opposite of Truncate: later segments are removed,
+and the segment off is in is cut down to end with it and becomes the active segment again.
+Raft uses it to remove the entries a follower has that conflict with the new leader's.
+It waits for the compaction or compression in progress, since the segment it cuts down may be the one that's rewritten.
+*/
+func (l *Log) TruncateAfter(off uint64) error {
+	l.rewriteMu.Lock()
+	defer l.rewriteMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.truncateFrom(off + 1)
+}
+
+// truncateFrom removes the records at off and after it. The caller must hold the lock.
+func (l *Log) truncateFrom(off uint64) error {
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.baseOffset >= off {
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -179,32 +557,129 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	if len(segments) == 0 {
+		return l.newSegment(off)
+	}
+
+	s := segments[len(segments)-1]
+	if err := s.truncateAfter(off - 1); err != nil {
+		return err
+	}
+	l.activeSegment = s
+	if s.IsMaxed() {
+		return l.newSegment(s.nextOffset)
+	}
 	return nil
 }
 
-type originReader struct {
-	*store
-	off int64
+// retentionCutoff returns the lowest offset the log should keep according to its retention config.
+// The cutoff always falls on a segment boundary, and the active segment is never cut off.
+func (l *Log) retentionCutoff(now time.Time) uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	r := l.Config.Retention
+	var size, records uint64
+	for _, s := range l.segments {
+		size += s.store.diskSize() + s.index.size
+		records += s.records()
+	}
+	cutoff := l.segments[0].baseOffset
+	for i, s := range l.segments[:len(l.segments)-1] {
+		expired := (r.MaxBytes > 0 && size > r.MaxBytes) ||
+			(r.MaxRecords > 0 && records > r.MaxRecords)
+		// the age goes by the records' append times, which every server agrees on, rather than by the files', which compaction
+		// and compression reset when they rewrite the segment
+		if !expired && r.MaxAge > 0 {
+			expired = now.Sub(time.Unix(0, s.maxTime)) > r.MaxAge
+		}
+		// segments are ordered from oldest to newest, so nothing after this one can be expired either
+		if !expired {
+			break
+		}
+		size -= s.store.diskSize() + s.index.size
+		records -= s.records()
+		cutoff = l.segments[i+1].baseOffset
+	}
+	return cutoff
 }
 
-// Reader returns an io.Reader to read the whole log. We'll need it for implementing snapshots and restoring  a log.
-func (l *Log) Reader() io.Reader {
+/*
+Reader returns an io.ReadCloser to read the whole log, as it is when Reader is called. Every record is framed the way
+a checksummed store frames it, whatever store it's in: length | crc32 of the record | record.
+We'll need it for implementing snapshots and restoring a log. The segments are held until the reader is closed,
+so truncation, compaction and compression can carry on in the meantime without pulling them out from under it.
+*/
+func (l *Log) Reader() io.ReadCloser {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	readers := make([]io.Reader, len(l.segments))
-	for i, segment := range l.segments {
-		//Why wrap with originReader?
-		//1. to satisfy io.Reader interface, 2. make sure we start reading from the origin of the store and read the entire file
-		readers[i] = &originReader{segment.store, 0}
+	r := &logReader{log: l}
+	for _, s := range l.segments {
+		s.acquire()
+		r.segments = append(r.segments, s)
+		r.entries = append(r.entries, s.records())
+	}
+	return r
+}
+
+// logReader reads the records of the segments, each one up to the num of records it had when the reader was made
+type logReader struct {
+	log      *Log
+	segments []*segment
+	entries  []uint64
+	entry    uint64 // the index entry of the next record in the first segment
+	frame    []byte // what's left of the last record read
+}
+
+func (r *logReader) Read(p []byte) (int, error) {
+	for len(r.frame) == 0 {
+		for len(r.segments) > 0 && r.entry == r.entries[0] {
+			if err := r.segments[0].release(); err != nil {
+				return 0, err
+			}
+			r.segments, r.entries, r.entry = r.segments[1:], r.entries[1:], 0
+		}
+		if len(r.segments) == 0 {
+			return 0, io.EOF
+		}
+		record, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		r.frame = make([]byte, recordHeaderBytes, recordHeaderBytes+len(record))
+		enc.PutUint64(r.frame[:recordLenBytes], uint64(len(record)))
+		enc.PutUint32(r.frame[recordLenBytes:], crc32.Checksum(record, crcTable))
+		r.frame = append(r.frame, record...)
+		r.entry++
+	}
+	n := copy(p, r.frame)
+	r.frame = r.frame[n:]
+	return n, nil
+}
+
+// next reads the bytes of the next record of the first segment
+func (r *logReader) next() ([]byte, error) {
+	s := r.segments[0]
+	// a compressed store takes over from the store it was compressed from under the lock, at the same positions
+	r.log.mu.RLock()
+	defer r.log.mu.RUnlock()
+	relOff, pos, err := s.index.Read(int64(r.entry))
+	if err != nil {
+		return nil, err
+	}
+	record, err := s.store.Read(pos)
+	if err == errChecksumMismatch {
+		return nil, api.ErrCorruptRecord{Offset: s.baseOffset + uint64(relOff)}
 	}
-	return io.MultiReader(readers...) //concatenates the segments' stores.
+	return record, err
 }
 
-func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
-	o.off += int64(n)
-	return n, err
+// Close releases the segments the reader didn't get to the end of
+func (r *logReader) Close() error {
+	err := releaseAll(r.segments)
+	r.segments, r.entries = nil, nil
+	return err
 }
 
 // newSegment creates a new segment, appends it to the segment list and sets it to active
@@ -1,10 +1,15 @@
 package log
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/raft"
 	api "github.com/innazh/proglog/api/v1"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
@@ -19,6 +24,17 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"corrupt record error":              testCorruptRecordErr,
+		"recover after crash":               testRecoverCrash,
+		"recover keeps corrupt records":     testRecoverKeepsCorrupt,
+		"retention cutoff":                  testRetentionCutoff,
+		"offset for time":                   testOffsetForTime,
+		"truncate after":                    testTruncateAfter,
+		"append batch":                      testAppendBatch,
+		"wait for an offset":                testWait,
+		"read batch":                        testReadBatch,
+		"raft's delete range":               testDeleteRange,
+		"rollback":                          testRollback,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "store-test")
@@ -26,7 +42,7 @@ func TestLog(t *testing.T) {
 			defer os.RemoveAll(dir)
 
 			c := Config{}
-			c.Segment.MaxStoreBytes = 32
+			c.Segment.MaxStoreBytes = 64
 			log, err := NewLog(dir, c)
 			require.NoError(t, err)
 
@@ -94,13 +110,23 @@ func testReader(t *testing.T, log *Log) {
 	require.Equal(t, uint64(0), off)
 
 	reader := log.Reader()
+	// the reader reads the log as it was when it was made, whatever happens to the log in the meantime
+	for len(log.segments) < 2 {
+		_, err = log.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Truncate(log.activeSegment.baseOffset-1))
+	require.Equal(t, 1, len(log.segments))
 	b, err := io.ReadAll(reader)
 	require.NoError(t, err)
+	require.NoError(t, reader.Close())
 
 	read := &api.Record{}
-	err = proto.Unmarshal(b[recordLenBytes:], read)
+	err = proto.Unmarshal(b[recordHeaderBytes:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
+	require.Equal(t, uint64(0), read.Offset)
+	require.Equal(t, recordHeaderBytes+proto.Size(read), len(b))
 	require.NoError(t, log.Close())
 }
 
@@ -120,3 +146,678 @@ func testTruncate(t *testing.T, log *Log) {
 	require.Error(t, err)
 	require.NoError(t, log.Close())
 }
+
+func testTruncateAfter(t *testing.T, log *Log) {
+	// two records per segment: [0, 1] [2, 3] [4, 5] [6]
+	for i := int64(0); i < 7; i++ {
+		_, err := log.Append(&api.Record{
+			Value:      []byte("hello world"),
+			AppendTime: (i + 1) * 100,
+		})
+		require.NoError(t, err)
+	}
+
+	// cut in the middle of a segment, the ones after it are removed
+	require.NoError(t, log.TruncateAfter(2))
+	require.Equal(t, 2, len(log.segments))
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	_, err = log.Read(3)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	// the time index was cut too
+	off, err = log.OffsetForTime(350)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// the log carries on from there
+	for i := uint64(3); i < 6; i++ {
+		off, err = log.Append(&api.Record{Value: []byte("conflict")})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	read, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("conflict"), read.Value)
+	read, err = log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+
+	// and it all survives a restart
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.Nil(t, n.Repairs())
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	// cutting before the first record leaves an empty log that starts right after the cut
+	require.NoError(t, n.Truncate(1))
+	require.NoError(t, n.TruncateAfter(0))
+	off, err = n.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.NoError(t, n.Close())
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	batch := func() []*api.Record {
+		return []*api.Record{
+			{Value: []byte("first")},
+			{Value: []byte("second")},
+			{Value: []byte("third")},
+		}
+	}
+
+	// two records per segment, so the batch needs a new one after its first record: make creating it fail
+	storeDir := filepath.Join(log.Dir, "2.store")
+	require.NoError(t, os.Mkdir(storeDir, 0700))
+	_, _, err = log.AppendBatch(batch())
+	require.Error(t, err)
+	// nothing of the batch was kept
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	_, err = log.Read(1)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	require.NoError(t, os.Remove(storeDir))
+
+	first, last, err := log.AppendBatch(batch())
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(3), last)
+	for i, record := range batch() {
+		read, err := log.Read(first + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, record.Value, read.Value)
+	}
+
+	_, _, err = log.AppendBatch(nil)
+	require.Equal(t, errEmptyBatch, err)
+	require.NoError(t, log.Close())
+}
+
+func testReadBatch(t *testing.T, log *Log) {
+	record := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	size := uint64(proto.Size(&api.Record{Value: []byte("hello world"), Offset: 1, AppendTime: time.Now().UnixNano()}))
+
+	// batches span segments, up to the end of the log
+	records, err := log.ReadBatch(1, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	for i, record := range records {
+		require.Equal(t, uint64(1+i), record.Offset)
+	}
+
+	records, err = log.ReadBatch(0, 2, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	records, err = log.ReadBatch(0, 0, 3*size)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	// the first record is returned whatever its size
+	records, err = log.ReadBatch(0, 0, 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	_, err = log.ReadBatch(5, 0, 0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+func testWait(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// there's already a record at the offset
+	require.NoError(t, log.Wait(context.Background(), 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, log.Wait(ctx, 1), context.DeadlineExceeded)
+
+	waited := make(chan error)
+	go func() {
+		waited <- log.Wait(context.Background(), 2)
+	}()
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	select {
+	case err = <-waited:
+		t.Fatalf("wait returned before offset 2 was appended: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	_, _, err = log.AppendBatch([]*api.Record{{Value: []byte("hello")}, {Value: []byte("world")}})
+	require.NoError(t, err)
+	require.NoError(t, <-waited)
+	require.NoError(t, log.Close())
+}
+
+func testCorruptRecordErr(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+
+	// flip the last byte of the record on disk
+	s := log.activeSegment.store
+	_, err = s.ReadAt(make([]byte, 1), 0) // flushes the buffer
+	require.NoError(t, err)
+	f, err := os.OpenFile(s.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(s.size-1))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{^b[0]}, int64(s.size-1))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	read, err := log.Read(off)
+	require.Nil(t, read)
+	apiErr := err.(api.ErrCorruptRecord)
+	require.Equal(t, off, apiErr.Offset)
+	require.NoError(t, log.Close())
+}
+
+func testRecoverCrash(t *testing.T, o *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(append)
+		require.NoError(t, err)
+	}
+
+	// simulate a crash: the buffered writes make it to disk but the log is never closed,
+	// so the index files keep their pre-truncated size and are zero-filled past the last entry
+	for _, s := range o.segments {
+		_, err := s.store.ReadAt(make([]byte, 1), 0)
+		require.NoError(t, err)
+	}
+	active := o.activeSegment
+	// and the process died in the middle of appending another record
+	f, err := os.OpenFile(active.store.Name(), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	torn := []byte{0, 0, 0, 0, 0, 0, 0, 42, 1, 2}
+	_, err = f.Write(torn)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+
+	repairs := n.Repairs()
+	require.Equal(t, 2, len(repairs))
+	require.Equal(t, active.baseOffset, repairs[1].BaseOffset)
+	require.Equal(t, uint64(len(torn)), repairs[1].StoreBytesDropped)
+	require.True(t, repairs[1].IndexEntriesDropped > 0)
+
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	off, err = n.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	for i := uint64(0); i <= off; i++ {
+		read, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+	require.NoError(t, n.Close())
+
+	// a cleanly closed log doesn't need repairs
+	n, err = NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	require.Nil(t, n.Repairs())
+	require.NoError(t, n.Close())
+}
+
+func TestLogBaselineFormat(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-baseline-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a log written before records were checksummed: a store of length | record, and an index without a time index
+	var store, index []byte
+	for i := 0; i < 3; i++ {
+		p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: uint64(i)})
+		require.NoError(t, err)
+		index = enc.AppendUint32(index, uint32(i))
+		index = enc.AppendUint64(index, uint64(len(store)))
+		store = enc.AppendUint64(store, uint64(len(p)))
+		store = append(store, p...)
+	}
+	logDir := filepath.Join(dir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(logDir, "0.store"), store, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(logDir, "0.index"), index, 0600))
+
+	log, err := NewLog(logDir, Config{})
+	require.NoError(t, err)
+	require.Nil(t, log.Repairs())
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, log.Close())
+	log, err = NewLog(logDir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	require.Nil(t, log.Repairs())
+	for off := uint64(0); off < 4; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, []byte("hello world"), read.Value)
+	}
+
+	// the snapshots of the time were the log's stores one after the other
+	restoreDir := filepath.Join(dir, "restore")
+	require.NoError(t, os.Mkdir(restoreDir, 0700))
+	restored, err := NewLog(restoreDir, Config{})
+	require.NoError(t, err)
+	defer restored.Close()
+	f := newFSM(&DistributedLog{log: restored}, filepath.Join(dir, "topics"))
+	require.NoError(t, f.Restore(io.NopCloser(bytes.NewReader(store))))
+	for off := uint64(0); off < 3; off++ {
+		read, err := restored.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+	next, err := restored.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), next)
+}
+
+func testRecoverKeepsCorrupt(t *testing.T, o *Log) {
+	record := &api.Record{
+		Value: []byte("hello world"),
+	}
+	// two records per segment: [0, 1] [2, 3] [4, 5] []
+	for i := 0; i < 6; i++ {
+		_, err := o.Append(record)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, len(o.segments))
+	// bits flip in the segments that aren't the last one, which a crash can't tear
+	var flips []func()
+	for _, off := range []uint64{1, 4} {
+		s := o.segments[off/2]
+		_, pos, err := s.index.Read(int64(off - s.baseOffset))
+		require.NoError(t, err)
+		name := s.store.Name()
+		flips = append(flips, func() {
+			f, err := os.OpenFile(name, os.O_RDWR, 0600)
+			require.NoError(t, err)
+			b := make([]byte, 1)
+			at := int64(pos + recordHeaderBytes + 2)
+			_, err = f.ReadAt(b, at)
+			require.NoError(t, err)
+			_, err = f.WriteAt([]byte{^b[0]}, at)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+		})
+	}
+	require.NoError(t, o.Close())
+	for _, flip := range flips {
+		flip()
+	}
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Nil(t, n.Repairs())
+	for off := uint64(0); off < 6; off++ {
+		read, err := n.Read(off)
+		if off == 1 || off == 4 {
+			require.Equal(t, api.ErrCorruptRecord{Offset: off}, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+}
+
+func TestLogSyncPolicy(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncNever, SyncAlways, SyncPeriodic, SyncOnRoll} {
+		t.Run(policy.String(), func(t *testing.T) {
+			parsed, err := ParseSyncPolicy(policy.String())
+			require.NoError(t, err)
+			require.Equal(t, policy, parsed)
+
+			dir, err := os.MkdirTemp("", "log-sync-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+			c.Segment.Sync = policy
+			c.Segment.SyncInterval = 10 * time.Millisecond
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			// the first two records fill up the first segment, the third goes to the next one
+			for i := 0; i < 3; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			first, active := log.segments[0], log.activeSegment
+			onDisk := func(s *segment) bool {
+				fi, err := os.Stat(s.store.Name())
+				require.NoError(t, err)
+				return uint64(fi.Size()) == s.store.size
+			}
+
+			switch policy {
+			case SyncNever:
+				require.False(t, onDisk(first))
+				require.False(t, onDisk(active))
+			case SyncAlways:
+				require.True(t, onDisk(first))
+				require.True(t, onDisk(active))
+			case SyncPeriodic:
+				require.True(t, onDisk(first))
+				require.Eventually(t, func() bool {
+					return onDisk(active)
+				}, time.Second, 10*time.Millisecond)
+			case SyncOnRoll:
+				require.True(t, onDisk(first))
+				require.False(t, onDisk(active))
+			}
+			require.NoError(t, log.Close())
+			require.True(t, onDisk(active))
+		})
+	}
+
+	_, err := ParseSyncPolicy("sometimes")
+	require.Error(t, err)
+}
+
+func testRetentionCutoff(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	// two records per segment: [0, 1] [2, 3] [4, 5] [6]
+	for i := 0; i < 7; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, len(log.segments))
+
+	cutoff := log.retentionCutoff(time.Now())
+	require.Equal(t, uint64(0), cutoff)
+
+	log.Config.Retention.MaxRecords = 3
+	cutoff = log.retentionCutoff(time.Now())
+	require.Equal(t, uint64(4), cutoff)
+
+	log.Config.Retention.MaxRecords = 0
+	log.Config.Retention.MaxBytes = log.segments[3].store.size + log.segments[3].index.size
+	cutoff = log.retentionCutoff(time.Now())
+	require.Equal(t, uint64(6), cutoff)
+
+	// the age of a segment is the age of its newest record, whatever the age of its files, which rewriting them resets
+	log.Config.Retention.MaxBytes = 0
+	log.Config.Retention.MaxAge = time.Minute
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(log.segments[0].store.Name(), past, past))
+	cutoff = log.retentionCutoff(time.Now())
+	require.Equal(t, uint64(0), cutoff)
+
+	// the active segment is never cut off, no matter how old it is
+	cutoff = log.retentionCutoff(time.Now().Add(time.Hour))
+	require.Equal(t, uint64(6), cutoff)
+
+	require.NoError(t, log.Truncate(cutoff-1))
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+
+	// truncating past the highest offset keeps the active segment as well, the log still has somewhere to append to
+	require.NoError(t, log.Truncate(100))
+	off, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	off, err = log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	require.NoError(t, log.Close())
+}
+
+func testDeleteRange(t *testing.T, log *Log) {
+	store := &logStore{log}
+	// two entries per segment: [1, 2] [3, 4] [5, 6] [7]
+	for i := uint64(1); i <= 7; i++ {
+		require.NoError(t, store.StoreLog(&raft.Log{Index: i, Data: []byte("hello world")}))
+	}
+
+	// Raft deletes the entries in its snapshot from the front, whole segments are removed
+	require.NoError(t, store.DeleteRange(1, 4))
+	first, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), first)
+
+	// the last index is always kept, so the active segment it's in never gets to Truncate
+	require.NoError(t, store.DeleteRange(5, 6))
+	first, err = store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), first)
+	last, err := store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), last)
+	require.NoError(t, log.Close())
+}
+
+func testOffsetForTime(t *testing.T, log *Log) {
+	// two records per segment: [0, 1] [2, 3] [4, 5] [6]
+	for i := int64(0); i < 7; i++ {
+		_, err := log.Append(&api.Record{
+			Value:      []byte("hello world"),
+			AppendTime: (i + 1) * 100,
+		})
+		require.NoError(t, err)
+	}
+
+	for ts, want := range map[int64]uint64{
+		0:   0,
+		100: 0,
+		150: 1,
+		300: 2,
+		450: 4,
+		700: 6,
+		// past the last record we get the offset the next record will be appended at
+		701: 7,
+	} {
+		off, err := log.OffsetForTime(ts)
+		require.NoError(t, err)
+		require.Equal(t, want, off, "ts %d", ts)
+	}
+
+	// the time index should be read back from disk
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	off, err := n.OffsetForTime(450)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	read, err := n.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, int64(500), read.AppendTime)
+
+	// records without an append time are stored with the current one, the caller's record is left alone
+	record := &api.Record{Value: []byte("hello world")}
+	off, err = n.Append(record)
+	require.NoError(t, err)
+	require.Zero(t, record.AppendTime)
+	read, err = n.Read(off)
+	require.NoError(t, err)
+	require.NotZero(t, read.AppendTime)
+	require.NoError(t, n.Close())
+}
+
+func TestLogCompaction(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-compaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Compaction.TombstoneRetention = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	now := time.Now()
+	// two records per segment: [0, 1] [2, 3] [4, 5] [6]
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("a1")},
+		{Key: []byte("b"), Value: []byte("b1")},
+		{Key: []byte("a"), Value: []byte("a2")},
+		{Value: []byte("no key")},
+		{Key: []byte("b"), AppendTime: now.Add(-2 * time.Hour).UnixNano()},
+		{Key: []byte("a"), Value: []byte("a3")},
+		{Key: []byte("c"), Value: []byte("c1")},
+	}
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, len(log.segments))
+
+	// the tombstone of b is still within its retention, so only the old values go
+	require.NoError(t, log.Compact(now.Add(-90*time.Minute)))
+	require.Equal(t, 3, len(log.segments))
+	require.Equal(t, uint64(1), log.segments[0].records())
+	require.Equal(t, uint64(2), log.segments[1].records())
+
+	require.NoError(t, log.Compact(now))
+	require.Equal(t, 3, len(log.segments))
+	require.Equal(t, uint64(1), log.segments[1].records())
+
+	check := func(log *Log) {
+		off, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), off)
+		off, err = log.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(6), off)
+
+		_, err = log.Read(0)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+		// reading a compacted offset fails, consuming from it gets the next record that's left
+		for off, want := range map[uint64]uint64{2: 3, 3: 3, 4: 5, 5: 5, 6: 6} {
+			read, err := log.Read(off)
+			if want != off {
+				require.Equal(t, api.ErrOffsetNotFound{Offset: off}, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, records[want].Value, read.Value)
+			}
+			batch, err := log.ReadBatch(off, 1, 0)
+			require.NoError(t, err)
+			require.Equal(t, want, batch[0].Offset)
+			require.Equal(t, records[want].Value, batch[0].Value)
+		}
+		_, err = log.Read(7)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 7}, err)
+	}
+	check(log)
+
+	require.NoError(t, log.Close())
+
+	// a compaction that didn't finish before the log was closed is thrown away
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "4"+compactingExt), 0700))
+	n, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.NoDirExists(t, filepath.Join(dir, "4"+compactingExt))
+	check(n)
+
+	// new records carry on after the last offset, no matter what compaction left behind
+	off, err := n.Append(&api.Record{Key: []byte("c"), Value: []byte("c2")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	require.NoError(t, n.Close())
+}
+
+func TestLogCompactBelow(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-compaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// [0, 1] [2, 3] [4]
+	for _, v := range []string{"a1", "a2", "a3", "a4", "a5"} {
+		_, err := log.Append(&api.Record{Key: []byte("a"), Value: []byte(v)})
+		require.NoError(t, err)
+	}
+
+	// the newest record of a key is the newest one below the offset, the ones after it are left alone
+	require.NoError(t, log.compact(3, time.Now()))
+	_, err = log.Read(1)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, err)
+	for off := uint64(2); off < 5; off++ {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+
+	// the records below the offset are moved out of the active segment first: [2, 3] [4] []
+	require.NoError(t, log.rollBefore(5))
+	require.Equal(t, uint64(5), log.activeSegment.baseOffset)
+
+	// a segment that's removed while it's held can still be read by its holder, until it lets go of it
+	held := log.acquire(func(s *segment) bool { return s.baseOffset == 2 })
+	require.NoError(t, log.compact(5, time.Now()))
+	_, err = log.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+	read, err := held[0].Read(2)
+	require.NoError(t, err)
+	require.Equal(t, "a3", string(read.Value))
+	require.NoError(t, releaseAll(held))
+	read, err = log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, "a5", string(read.Value))
+}
+
+func testRollback(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.rollback(3))
+	next, err := log.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), next)
+	_, err = log.Read(2)
+	require.NoError(t, err)
+	_, err = log.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+
+	// the records before the next offset may have been compacted away
+	require.NoError(t, log.skipTo(6))
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	_, err = log.Read(4)
+	require.Equal(t, api.ErrOffsetNotFound{Offset: 4}, err)
+
+	// rolling back past the lowest offset leaves nothing behind
+	require.NoError(t, log.rollback(0))
+	next, err = log.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), next)
+	require.NoError(t, log.Close())
+}
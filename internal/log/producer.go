@@ -0,0 +1,116 @@
+package log
+
+import (
+	"fmt"
+	"slices"
+
+	api "github.com/innazh/proglog/api/v1"
+)
+
+/*
+InitProducer hands out an id for an idempotent producer. The id is the Raft index of the command that asked for it,
+so it's never handed out twice, snapshots and restarts included. Ask the metadata group for it: the indexes of the partitions'
+groups overlap with each other.
+*/
+func (l *DistributedLog) InitProducer() (uint64, error) {
+	res, _, err := l.apply(InitProducerRequestType, &api.InitProducerRequest{})
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.InitProducerResponse).ProducerId, nil
+}
+
+/*
+AppendIdempotent appends the records of an idempotent producer, which take the sequence nums from sequence on.
+If they're a retry of any of the last maxProducerBatches batches the log got from the producer, they aren't appended again
+and the offsets they got the first time are returned. Records that don't follow the last ones get api.ErrOutOfOrderSequence.
+Unlike Append, it isn't group committed: the records are committed with a single Raft command of their own,
+whose index is returned as well, see AppendIndexed.
+*/
+func (l *DistributedLog) AppendIdempotent(producerID, sequence uint64, records []*api.Record) (first, last, index uint64, err error) {
+	res, index, err := l.apply(
+		AppendBatchRequestType,
+		&api.ProduceBatchRequest{Records: records, ProducerId: producerID, Sequence: sequence},
+	)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	batch := res.(*api.ProduceBatchResponse)
+	return batch.FirstOffset, batch.LastOffset, index, nil
+}
+
+// producerBatch is what the fsm remembers of a producer's batch: the sequence nums of its records, and where they went
+type producerBatch struct {
+	first, last uint64 // sequence nums
+	offset      uint64 // of the record with the first sequence num
+}
+
+// maxProducerBatches is how many of a producer's latest batches the fsm remembers, a producer can retry any of them,
+// so it can have as many in flight at once
+const maxProducerBatches = 5
+
+// producerBatchBytes is the size of a producer's batch in the snapshots: the producer's id, followed by the fields of its producerBatch
+const producerBatchBytes = 4 * 8
+
+/*
+dedupe checks the sequence nums of an idempotent producer's records against the latest batches it appended. It returns
+the response of the original append for a retry of one of them, and api.ErrOutOfOrderSequence for records that don't follow
+the latest one. The first records the log gets from a producer can start at any sequence num.
+*/
+func (f *fsm) dedupe(req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	batches := f.producers[req.ProducerId]
+	if len(batches) == 0 {
+		return nil, nil
+	}
+	n := uint64(len(req.Records))
+	for _, b := range batches {
+		if req.Sequence == b.first && req.Sequence+n-1 == b.last {
+			return &api.ProduceBatchResponse{FirstOffset: b.offset, LastOffset: b.offset + n - 1}, nil
+		}
+	}
+	latest := batches[len(batches)-1]
+	if req.Sequence != latest.last+1 {
+		return nil, api.ErrOutOfOrderSequence{ProducerID: req.ProducerId, Expected: latest.last + 1, Sequence: req.Sequence}
+	}
+	return nil, nil
+}
+
+// appended remembers a batch the producer appended, forgetting its oldest one past maxProducerBatches
+func (f *fsm) appended(producerID uint64, b producerBatch) {
+	batches := append(f.producers[producerID], b)
+	if len(batches) > maxProducerBatches {
+		batches = slices.Delete(batches, 0, len(batches)-maxProducerBatches)
+	}
+	f.producers[producerID] = batches
+}
+
+// encodeProducers encodes the producers' batches for the snapshot, the batches of a producer from the oldest on
+func encodeProducers(producers map[uint64][]producerBatch) []byte {
+	b := make([]byte, 0, len(producers)*maxProducerBatches*producerBatchBytes)
+	for id, batches := range producers {
+		for _, p := range batches {
+			b = enc.AppendUint64(b, id)
+			b = enc.AppendUint64(b, p.first)
+			b = enc.AppendUint64(b, p.last)
+			b = enc.AppendUint64(b, p.offset)
+		}
+	}
+	return b
+}
+
+// decodeProducers decodes the producers' batches encoded by encodeProducers
+func decodeProducers(b []byte) (map[uint64][]producerBatch, error) {
+	if len(b)%producerBatchBytes != 0 {
+		return nil, fmt.Errorf("log: the producers of the snapshot take %d bytes, not a multiple of %d", len(b), producerBatchBytes)
+	}
+	producers := make(map[uint64][]producerBatch)
+	for ; len(b) > 0; b = b[producerBatchBytes:] {
+		id := enc.Uint64(b)
+		producers[id] = append(producers[id], producerBatch{
+			first:  enc.Uint64(b[8:]),
+			last:   enc.Uint64(b[16:]),
+			offset: enc.Uint64(b[24:]),
+		})
+	}
+	return producers, nil
+}
@@ -0,0 +1,146 @@
+package log
+
+import "io"
+
+// Repair describes what had to be cut off a segment when it was opened, e.g. after the process died mid-append.
+type Repair struct {
+	BaseOffset          uint64
+	StoreBytesDropped   uint64 // torn or unindexed records removed from the end of the store
+	IndexEntriesDropped uint64 // zero-filled or dangling entries removed from the end of the index
+
+	TimeIndexEntriesDropped uint64
+}
+
+/*
+recover validates the segment's index against its store and cuts off what a crash left half written. The index entries past
+the last valid one are dropped, e.g. the zero-filled ones of an index that wasn't truncated on Close.
+With tail set, which is for the last segment, the only one a crash can leave a torn write in, the records at the end of the store
+are checked too: the ones that are torn, fail their checksum or have no index entry are dropped, back to the last intact record.
+The corrupt records before it, like the ones of the other segments, are left for Read to report as api.ErrCorruptRecord.
+Time index entries pointing past the last record are dropped as well. Returns nil if the segment didn't need repairing.
+*/
+func (s *segment) recover(tail bool) (*Repair, error) {
+	// an index that was never truncated on Close has the size of the whole mmap, so only trust the entries that make sense
+	indexed := s.index.size / entWidth
+	if max := uint64(len(s.index.mmap)) / entWidth; indexed > max {
+		indexed = max
+	}
+	var consistent uint64
+	var prevOff uint32
+	var prevPos uint64
+	for ; consistent < indexed; consistent++ {
+		entry := consistent * entWidth
+		off := enc.Uint32(s.index.mmap[entry : entry+offWidth])
+		pos := enc.Uint64(s.index.mmap[entry+offWidth : entry+entWidth])
+		if pos >= s.store.size ||
+			(consistent == 0 && pos != s.store.begin()) ||
+			(consistent > 0 && (off <= prevOff || pos <= prevPos)) {
+			break
+		}
+		prevOff, prevPos = off, pos
+	}
+
+	storeEnd := s.store.size
+	if tail {
+		// the records are checked from the end, a crash only tears the last ones
+		storeEnd = s.store.begin()
+		for ; consistent > 0; consistent-- {
+			entry := (consistent - 1) * entWidth
+			end, ok, err := s.store.intact(enc.Uint64(s.index.mmap[entry+offWidth : entry+entWidth]))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				storeEnd = end
+				break
+			}
+		}
+	}
+	repair := &Repair{
+		BaseOffset:          s.baseOffset,
+		StoreBytesDropped:   s.store.size - storeEnd,
+		IndexEntriesDropped: s.index.size/entWidth - consistent,
+	}
+	repaired := repair.StoreBytesDropped > 0 ||
+		repair.IndexEntriesDropped > 0 ||
+		s.index.size%entWidth != 0
+	if repaired {
+		if repair.StoreBytesDropped > 0 {
+			if err := s.store.truncate(storeEnd); err != nil {
+				return nil, err
+			}
+		}
+		s.index.truncate(consistent)
+		s.setNextOffset()
+	}
+
+	// the time index can only point at the records that are left, in increasing time and offset order
+	timeEntries := s.timeIndex.size / timeEntWidth
+	var validTime uint64
+	var prevTs int64
+	var prevRelOff uint32
+	for ; validTime < timeEntries; validTime++ {
+		ts, relOff, err := s.timeIndex.Read(int64(validTime))
+		if err != nil ||
+			ts <= prevTs ||
+			(validTime > 0 && relOff <= prevRelOff) ||
+			s.baseOffset+uint64(relOff) >= s.nextOffset {
+			break
+		}
+		prevTs, prevRelOff = ts, relOff
+	}
+	repair.TimeIndexEntriesDropped = timeEntries - validTime
+	if repair.TimeIndexEntriesDropped > 0 || s.timeIndex.size%timeEntWidth != 0 {
+		s.timeIndex.truncate(validTime)
+		repaired = true
+	}
+
+	if !repaired {
+		return nil, nil
+	}
+	s.setMaxTime()
+	return repair, nil
+}
+
+// intact tells whether the record at pos is complete and matches its checksum, and returns the position right after it
+func (s *store) intact(pos uint64) (end uint64, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return 0, false, err
+	}
+	p, err := s.read(pos)
+	if err == errChecksumMismatch || err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return pos + s.frameBytes() + uint64(len(p)), true, nil
+}
+
+// truncate cuts the store's file down to size bytes
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.compressed != nil {
+		return errCompressedStore
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+// truncate keeps the first entries of the index and zeroes the rest,
+// so stale entries past the end can't be mistaken for valid ones after another crash
+func (i *index) truncate(entries uint64) {
+	i.size = entries * entWidth
+	clear(i.mmap[i.size:])
+}
@@ -2,8 +2,11 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	api "github.com/innazh/proglog/api/v1"
 	"google.golang.org/protobuf/proto"
@@ -13,8 +16,14 @@ import (
 type segment struct {
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
+	maxTime                int64 // the largest append time of the segment's records
 	config                 Config
+
+	refMu   sync.Mutex
+	refs    int  // num of holders reading the segment without the log's lock, see acquire
+	closing bool // the segment was closed while it was held, the last release closes it
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -22,40 +31,105 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		baseOffset: baseOffset,
 		config:     c,
 	}
-	storeFile, err := os.OpenFile(
-		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+	if err := s.openStore(dir); err != nil {
+		return nil, err
+	}
+	indexFile, err := os.OpenFile(
+		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		os.O_RDWR|os.O_CREATE,
 		0600,
 	)
 	if err != nil {
 		return nil, err
 	}
-	if s.store, err = newStore(storeFile); err != nil {
+	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
-	indexFile, err := os.OpenFile(
-		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+	timeIndexFile, err := os.OpenFile(
+		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")),
 		os.O_RDWR|os.O_CREATE,
 		0600,
 	)
 	if err != nil {
 		return nil, err
 	}
-	if s.index, err = newIndex(indexFile, c); err != nil {
+	if s.timeIndex, err = newTimeIndex(timeIndexFile, c); err != nil {
 		return nil, err
 	}
+	s.setNextOffset()
+	s.setMaxTime()
+	return s, nil
+}
+
+// openStore opens the segment's compressed store if it was compressed, otherwise its regular store
+func (s *segment) openStore(dir string) error {
+	storeName := filepath.Join(dir, fmt.Sprintf("%d%s", s.baseOffset, ".store"))
+	compressedName := filepath.Join(dir, fmt.Sprintf("%d%s", s.baseOffset, compressedExt))
+	if f, err := os.Open(compressedName); err == nil {
+		if s.store, err = newCompressedStore(f); err != nil {
+			f.Close()
+			return err
+		}
+		// the process died after compressing the store, before it got to remove the original
+		if err = os.Remove(storeName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	storeFile, err := os.OpenFile(storeName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if s.store, err = newStore(storeFile); err != nil {
+		return err
+	}
+	s.store.syncOnAppend = s.config.Segment.Sync == SyncAlways
+	return nil
+}
+
+// setNextOffset derives the offset of the next record from the last index entry
+func (s *segment) setNextOffset() {
 	if off, _, err := s.index.Read(-1); err != nil {
-		s.nextOffset = baseOffset
+		s.nextOffset = s.baseOffset
 	} else {
-		s.nextOffset = baseOffset + uint64(off) + 1
+		s.nextOffset = s.baseOffset + uint64(off) + 1
 	}
-	return s, nil
 }
 
-// Append appends data to the store and adds an index entry
+// setMaxTime finds the largest append time in the segment: the time of the last time index entry,
+// or of one of the few records appended after it. Records that can't be read are skipped, recovery deals with them.
+func (s *segment) setMaxTime() {
+	s.maxTime = 0
+	off := s.baseOffset
+	if ts, relOff, err := s.timeIndex.Read(-1); err == nil {
+		s.maxTime = ts
+		off = s.baseOffset + uint64(relOff) + 1
+	}
+	for off < s.nextOffset {
+		record, err := s.readFrom(off)
+		if err != nil {
+			break
+		}
+		if record.AppendTime > s.maxTime {
+			s.maxTime = record.AppendTime
+		}
+		off = record.Offset + 1
+	}
+}
+
+// Append appends data to the store and adds an index entry, and a time index entry every Segment.TimeIndexInterval records.
+// The record's offset is set to the one it gets. Records that don't have an append time yet are stored with the current time,
+// the caller's record is left without one: the records of the replicated log are stamped by the fsm, before they get here.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
 	record.Offset = cur
+	if record.AppendTime == 0 {
+		record = proto.Clone(record).(*api.Record)
+		record.AppendTime = time.Now().UnixNano()
+	}
 	p, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
@@ -65,20 +139,125 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 		return 0, err
 	}
 	// index offsets are relative to base offset:
-	if err = s.index.Write(uint32(s.nextOffset-uint64(s.baseOffset)), pos); err != nil {
+	relOff := uint32(s.nextOffset - uint64(s.baseOffset))
+	if err = s.index.Write(relOff, pos); err != nil {
 		return 0, err
 	}
+	if record.AppendTime > s.maxTime {
+		s.maxTime = record.AppendTime
+		_, lastRelOff, err := s.timeIndex.Read(-1)
+		if err != nil || uint64(relOff-lastRelOff) >= s.config.Segment.TimeIndexInterval {
+			// the time index is sparse, so it's fine to stop adding entries once it's full
+			if err := s.timeIndex.Write(record.AppendTime, relOff); err != nil && err != io.EOF {
+				return 0, err
+			}
+		}
+	}
 	s.nextOffset++
 	return cur, nil
 }
 
-// Read, given offset, checks the index to get the position of the requested record, then returns the record at that position
+// appendAt appends the record at its own offset instead of the next one, leaving a gap in the segment if there's one in between.
+// It's used to copy records over without changing their offsets, e.g. when restoring a snapshot of a compacted log.
+func (s *segment) appendAt(record *api.Record) (uint64, error) {
+	if record.Offset < s.nextOffset {
+		return 0, fmt.Errorf("can't append offset %d before the segment's next offset %d", record.Offset, s.nextOffset)
+	}
+	next := s.nextOffset
+	s.nextOffset = record.Offset
+	off, err := s.Append(record)
+	if err != nil {
+		s.nextOffset = next
+	}
+	return off, err
+}
+
+// truncateAfter removes the records after off from the segment. A compressed segment is decompressed first, so it can be appended to again.
+func (s *segment) truncateAfter(off uint64) error {
+	if off+1 >= s.nextOffset {
+		return nil
+	}
+	if s.store.compressed != nil {
+		if err := s.decompress(); err != nil {
+			return err
+		}
+	}
+	relOff := off - s.baseOffset
+	keep, storeEnd := s.records(), s.store.size
+	if entry, err := s.index.find(uint32(relOff + 1)); err == nil {
+		keep = uint64(entry)
+		if _, storeEnd, err = s.index.Read(entry); err != nil {
+			return err
+		}
+	}
+	if err := s.store.truncate(storeEnd); err != nil {
+		return err
+	}
+	s.index.truncate(keep)
+
+	timeEntries := s.timeIndex.size / timeEntWidth
+	for ; timeEntries > 0; timeEntries-- {
+		if _, entRelOff, err := s.timeIndex.Read(int64(timeEntries - 1)); err == nil && uint64(entRelOff) <= relOff {
+			break
+		}
+	}
+	s.timeIndex.truncate(timeEntries)
+
+	s.nextOffset = off + 1
+	s.setMaxTime()
+	return nil
+}
+
+// OffsetForTime returns the offset of the first record appended at or after ts (unix nanoseconds), ok is false if there's none in this segment
+func (s *segment) OffsetForTime(ts int64) (offset uint64, ok bool, err error) {
+	if s.nextOffset == s.baseOffset || s.maxTime < ts {
+		return 0, false, nil
+	}
+	off := s.baseOffset
+	if relOff, found := s.timeIndex.Lookup(ts); found {
+		off += uint64(relOff)
+	}
+	for off < s.nextOffset {
+		record, err := s.readFrom(off)
+		if err != nil {
+			return 0, false, err
+		}
+		if record.AppendTime >= ts {
+			return record.Offset, true, nil
+		}
+		off = record.Offset + 1
+	}
+	return 0, false, nil
+}
+
+// Read, given offset, checks the index to get the position of the requested record, then returns the record at that position.
+// Returns api.ErrOffsetNotFound if compaction removed the record, and api.ErrCorruptRecord if its bytes don't match their checksum.
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	return s.read(off, true)
+}
+
+// readFrom returns the record at off, or the next one after it if compaction removed it,
+// so callers should go by the returned record's offset
+func (s *segment) readFrom(off uint64) (*api.Record, error) {
+	return s.read(off, false)
+}
+
+func (s *segment) read(off uint64, exact bool) (*api.Record, error) {
+	entry, err := s.index.find(uint32(off - s.baseOffset))
+	if err != nil {
+		return nil, err
+	}
+	relOff, pos, err := s.index.Read(entry)
 	if err != nil {
 		return nil, err
 	}
+	if exact && s.baseOffset+uint64(relOff) != off {
+		return nil, api.ErrOffsetNotFound{Offset: off}
+	}
 	p, err := s.store.Read(pos)
+	if err == errChecksumMismatch {
+		return nil, api.ErrCorruptRecord{Offset: s.baseOffset + uint64(relOff)}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -87,6 +266,11 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return record, err
 }
 
+// records returns the num of records in the segment, which is less than its offset range if it was compacted
+func (s *segment) records() uint64 {
+	return s.index.size / entWidth
+}
+
 // IsMaxed returns true if we reached space limit for this paricular segment and need to now create a new one
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
@@ -94,25 +278,73 @@ func (s *segment) IsMaxed() bool {
 		s.index.isMaxed()
 }
 
-// Remove closes segment and removes the index and store files
+// Remove removes the index and store files and closes segment. The holders of the segment can keep reading it until they release it.
 func (s *segment) Remove() error {
-	if err := s.Close(); err != nil {
-		return err
-	}
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
-	return nil
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
+	return s.Close()
 }
 
-// Closes index & store files, flushes any unwritten writes, frees up memory
+// Sync commits the segment's store and index to stable storage
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	return s.timeIndex.Sync()
+}
+
+/*
+acquire holds the segment open for reading it without the log's lock, e.g. while it's rewritten or its records are sent to a snapshot.
+Truncation and rewrites can remove the segment in the meantime: it's closed once every holder released it.
+The caller must hold the log's lock, so the segment is still one of the log's when it's acquired.
+*/
+func (s *segment) acquire() {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	s.refs++
+}
+
+// release lets go of the segment, closing it if it was closed while it was held
+func (s *segment) release() error {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	s.refs--
+	if s.refs > 0 || !s.closing {
+		return nil
+	}
+	s.closing = false
+	return s.close()
+}
+
+// Close closes the segment, or leaves it to the last holder to close if it's held
 func (s *segment) Close() error {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	if s.refs > 0 {
+		s.closing = true
+		return nil
+	}
+	return s.close()
+}
+
+// Closes index & store files, flushes any unwritten writes, frees up memory
+func (s *segment) close() error {
 	if err := s.index.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
@@ -43,7 +43,7 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, s.Close())
 
 	p, _ := proto.Marshal(want)
-	c.Segment.MaxStoreBytes = uint64(len(p)+recordLenBytes) * 4
+	c.Segment.MaxStoreBytes = uint64(len(p)+recordHeaderBytes) * 4
 	c.Segment.MaxIndexBytes = 1024
 	s, err = newSegment(dir, 16, c)
 	require.NoError(t, err)
@@ -57,3 +57,61 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.IsMaxed())
 	require.NoError(t, s.Close())
 }
+
+func TestSegmentRecover(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-recover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+	// the store lost its last record (e.g. it was still buffered) but the index entry made it
+	_, err = s.store.ReadAt(make([]byte, 1), 0)
+	require.NoError(t, err)
+	_, lastPos, err := s.index.Read(2)
+	require.NoError(t, err)
+	require.NoError(t, s.store.File.Truncate(int64(lastPos)+3))
+	s.store.size = lastPos + 3
+
+	repair, err := s.recover(true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), repair.BaseOffset)
+	require.Equal(t, uint64(3), repair.StoreBytesDropped)
+	require.Equal(t, uint64(1), repair.IndexEntriesDropped)
+	require.Equal(t, uint64(18), s.nextOffset)
+
+	got, err := s.Read(17)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+	_, err = s.Read(18)
+	require.Equal(t, io.EOF, err)
+
+	repair, err = s.recover(true)
+	require.NoError(t, err)
+	require.Nil(t, repair)
+
+	// a corrupt record before the last intact one isn't a torn write, it's kept for Read to report
+	_, firstPos, err := s.index.Read(0)
+	require.NoError(t, err)
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(firstPos+recordHeaderBytes))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	repair, err = s.recover(true)
+	require.NoError(t, err)
+	require.Nil(t, repair)
+	_, err = s.Read(16)
+	require.Equal(t, api.ErrCorruptRecord{Offset: 16}, err)
+	require.NoError(t, s.Close())
+}
@@ -2,17 +2,33 @@ package log
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"os"
 	"sync"
 )
 
 var (
 	enc = binary.BigEndian
+
+	// crcTable is used to checksum every record we frame in the store
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// errChecksumMismatch is returned by the store when a record's bytes don't match the checksum written alongside them
+	errChecksumMismatch = errors.New("log: record checksum mismatch")
+
+	// storeMagic starts the stores whose records are checksummed. The stores written before, which are still read and appended to
+	// the way they were written, start with the length of their first record instead, whose first byte is always zero.
+	storeMagic = []byte("plstore1")
 )
 
 const (
-	recordLenBytes = 8 //8 of bytes for uint64
+	recordLenBytes    = 8 //8 of bytes for uint64
+	crcBytes          = 4 //4 bytes for the crc32 checksum of the record
+	recordHeaderBytes = recordLenBytes + crcBytes
 )
 
 type store struct {
@@ -20,6 +36,11 @@ type store struct {
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+
+	syncOnAppend bool // fsync every appended record instead of leaving it in the buffer/page cache
+	legacy       bool // the store was written before records were checksummed: it has no header, and its records are framed as length | record
+
+	compressed *compressedReader // set for the stores of closed segments that were compressed, they're read-only
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -28,22 +49,81 @@ func newStore(f *os.File) (*store, error) {
 		return nil, err
 	}
 	size := uint64(fi.Size())
-	return &store{
+	s := &store{
 		File: f,
 		size: size,
 		buf:  bufio.NewWriter(f),
-	}, nil
+	}
+	if err = s.readFormat(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readFormat tells the store's format by its first bytes. An empty store gets the header, so does one whose header got torn.
+func (s *store) readFormat() error {
+	head := make([]byte, min(s.size, uint64(len(storeMagic))))
+	if _, err := s.readAt(head, 0); err != nil {
+		return err
+	}
+	switch {
+	case len(head) > 0 && head[0] == 0:
+		s.legacy = true
+		return nil
+	case bytes.Equal(head, storeMagic):
+		return nil
+	case !bytes.HasPrefix(storeMagic, head):
+		return fmt.Errorf("log: %s isn't a store", s.Name())
+	case s.compressed != nil:
+		// compressed stores are complete, an empty one was compressed from an empty legacy store
+		s.legacy = true
+		return nil
+	}
+	if err := s.File.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.buf.Write(storeMagic); err != nil {
+		return err
+	}
+	s.size = uint64(len(storeMagic))
+	return nil
+}
+
+// begin returns the position of the store's first record, right after its header
+func (s *store) begin() uint64 {
+	if s.legacy {
+		return 0
+	}
+	return uint64(len(storeMagic))
+}
+
+// frameBytes returns the size of the frame that comes before every record of the store
+func (s *store) frameBytes() uint64 {
+	if s.legacy {
+		return recordLenBytes
+	}
+	return recordHeaderBytes
 }
 
 // Append persists given bytes p to the store. Returns the num of bytes written, record's starting position and error.
+// Every record is framed as: length (8 bytes) | crc32 of the record (4 bytes) | record, the crc32 is left out in a legacy store.
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.compressed != nil {
+		return 0, 0, errCompressedStore
+	}
+
 	pos = s.size
 	//we're using buffer instead of writing to the file directly for performance reasons
-	//this writes the length of data to the buffer:
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	//this writes the length of data and its checksum to the buffer:
+	header := make([]byte, s.frameBytes())
+	enc.PutUint64(header[:recordLenBytes], uint64(len(p)))
+	if !s.legacy {
+		enc.PutUint32(header[recordLenBytes:], crc32.Checksum(p, crcTable))
+	}
+	if _, err := s.buf.Write(header); err != nil {
 		return 0, 0, err
 	}
 	//here we actually write p to the buffer
@@ -52,12 +132,32 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 		return 0, 0, err
 	}
 
-	bytesWritten += recordLenBytes
+	bytesWritten += len(header)
 	s.size += uint64(bytesWritten)
+	if s.syncOnAppend {
+		if err := s.sync(); err != nil {
+			return 0, 0, err
+		}
+	}
 	return uint64(bytesWritten), pos, nil
 }
 
-// Read returns a sequence of bytes from the store, given its position
+// Sync flushes the buffer and commits the store's file to stable storage
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sync()
+}
+
+func (s *store) sync() error {
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// Read returns a sequence of bytes from the store, given its position. Returns errChecksumMismatch if the bytes on disk got corrupted,
+// which a legacy store can only tell for a length that runs past its end.
 func (s *store) Read(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -65,17 +165,30 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	if err := s.buf.Flush(); err != nil {
 		return nil, err
 	}
+	return s.read(pos)
+}
+
+// read reads the record at pos. The caller must hold the lock and have flushed the buffer.
+func (s *store) read(pos uint64) ([]byte, error) {
 	//Since we first store the length of record aka the number of bytes to read, we first need to retrieve how many bytes we need to read to get the record in requested.
-	//get the size of the record:
-	size := make([]byte, recordLenBytes)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+	//get the size and the checksum of the record:
+	header := make([]byte, s.frameBytes())
+	if _, err := s.readAt(header, int64(pos)); err != nil {
 		return nil, err
 	}
-	//now read the record, which only starts after the position + the number of bytes to read (which is 8 bytes==recordLenBytes)
-	recordBytes := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(recordBytes, int64(pos+recordLenBytes)); err != nil {
+	size := enc.Uint64(header[:recordLenBytes])
+	if size > s.size || pos+uint64(len(header))+size > s.size {
+		// a flipped bit in the length would otherwise make us allocate and read garbage
+		return nil, errChecksumMismatch
+	}
+	//now read the record, which only starts after the position + the header (length and checksum)
+	recordBytes := make([]byte, size)
+	if _, err := s.readAt(recordBytes, int64(pos+uint64(len(header)))); err != nil {
 		return nil, err
 	}
+	if !s.legacy && crc32.Checksum(recordBytes, crcTable) != enc.Uint32(header[recordLenBytes:]) {
+		return nil, errChecksumMismatch
+	}
 	return recordBytes, nil
 }
 
@@ -88,15 +201,31 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 		return 0, err
 	}
 
+	return s.readAt(p, off)
+}
+
+// readAt reads from the store's file, decompressing it if needed. The caller must hold the lock.
+func (s *store) readAt(p []byte, off int64) (int, error) {
+	if s.compressed != nil {
+		return s.compressed.ReadAt(p, off)
+	}
 	return s.File.ReadAt(p, off)
 }
 
+// diskSize returns the num of bytes the store takes up on disk, which is less than its size if it's compressed
+func (s *store) diskSize() uint64 {
+	if s.compressed != nil {
+		return s.compressed.fileSize
+	}
+	return s.size
+}
+
 // Close persists any buffered data beforee closing the file
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if err := s.buf.Flush(); err != nil {
+	if err := s.sync(); err != nil {
 		return err
 	}
 	return s.File.Close()
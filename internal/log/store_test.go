@@ -9,7 +9,7 @@ import (
 
 var (
 	testRecord   = []byte("hello world")
-	testRecWidth = uint64(len(testRecord)) + recordLenBytes
+	testRecWidth = uint64(len(testRecord)) + recordHeaderBytes
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -34,14 +34,14 @@ func testAppend(t *testing.T, s *store) {
 	for i := uint64(1); i < 4; i++ {
 		n, pos, err := s.Append(testRecord)
 		require.NoError(t, err)
-		require.Equal(t, pos+n, testRecWidth*i)
+		require.Equal(t, pos+n, s.begin()+testRecWidth*i)
 	}
 }
 
 func testRead(t *testing.T, s *store) {
 	t.Helper()
 
-	var pos uint64
+	pos := s.begin()
 	for i := uint64(1); i < 4; i++ {
 		read, err := s.Read(pos)
 		require.NoError(t, err)
@@ -53,14 +53,14 @@ func testRead(t *testing.T, s *store) {
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 
-	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, recordLenBytes)
+	for i, off := uint64(1), int64(s.begin()); i < 4; i++ {
+		b := make([]byte, recordHeaderBytes)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, recordLenBytes, n)
+		require.Equal(t, recordHeaderBytes, n)
 
 		off += int64(n)
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[:recordLenBytes])
 
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
@@ -71,6 +71,68 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreCorruption(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "store_corruption_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	_, pos, err := s.Append(testRecord)
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.NoError(t, err)
+
+	// flip a bit in the record's bytes
+	b := make([]byte, 1)
+	_, err = s.ReadAt(b, int64(pos+recordHeaderBytes))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{b[0] ^ 1}, int64(pos+recordHeaderBytes))
+	require.NoError(t, err)
+
+	_, err = s.Read(pos)
+	require.Equal(t, errChecksumMismatch, err)
+
+	// a garbage length must not be trusted either
+	_, err = f.WriteAt([]byte{0xff}, int64(pos))
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.Equal(t, errChecksumMismatch, err)
+}
+
+func TestStoreLegacy(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "store_legacy_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// a store written before records were checksummed
+	legacy := enc.AppendUint64(nil, uint64(len(testRecord)))
+	legacy = append(legacy, testRecord...)
+	_, err = f.Write(legacy)
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.True(t, s.legacy)
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, testRecord, read)
+
+	// it keeps being appended to the way it was written
+	n, pos, err := s.Append(testRecord)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(legacy)), pos)
+	require.Equal(t, uint64(len(legacy)), n)
+	require.NoError(t, s.Sync())
+	s, err = newStore(f)
+	require.NoError(t, err)
+	require.True(t, s.legacy)
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, testRecord, read)
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := os.CreateTemp(os.TempDir(), "store_close_test")
 	require.NoError(t, err)
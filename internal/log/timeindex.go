@@ -0,0 +1,129 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tysonmote/gommap"
+)
+
+// These constants define the num of bytes that makeup each time index entry
+var (
+	timeWidth    uint64 = 8
+	relOffWidth  uint64 = 4
+	timeEntWidth        = timeWidth + relOffWidth
+)
+
+/*
+timeIndex is a sparse index from append time to offset, kept next to the offset index of each segment.
+Every entry holds the largest append time seen in the segment so far and the relative offset of the record that had it,
+so all the records before an entry's offset were appended before the entry's time.
+We only add an entry every Segment.TimeIndexInterval records, lookups scan the records in between.
+*/
+type timeIndex struct {
+	file *os.File
+	mmap gommap.MMap
+	size uint64
+}
+
+// newTimeIndex creates a time index for the given file, the same way newIndex does for the offset index.
+func newTimeIndex(f *os.File, c Config) (*timeIndex, error) {
+	idx := &timeIndex{file: f}
+
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	idx.size = uint64(fi.Size())
+	err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	idx.mmap, err = gommap.Map(idx.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Close syncs the memory-mapped entries, truncates the file to the entries that are actually in it and closes it.
+func (t *timeIndex) Close() error {
+	if err := t.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	if err := t.mmap.UnsafeUnmap(); err != nil {
+		return err
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	if err := t.file.Truncate(int64(t.size)); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
+
+// Read returns the entry number in, or the last entry if in is -1
+func (t *timeIndex) Read(in int64) (ts int64, relOff uint32, err error) {
+	if t.size == 0 {
+		return 0, 0, io.EOF
+	}
+	if in == -1 {
+		in = int64(t.size/timeEntWidth) - 1
+	}
+	pos := uint64(in) * timeEntWidth
+	if t.size < pos+timeEntWidth || uint64(len(t.mmap)) < pos+timeEntWidth {
+		return 0, 0, io.EOF
+	}
+	ts = int64(enc.Uint64(t.mmap[pos : pos+timeWidth]))
+	relOff = enc.Uint32(t.mmap[pos+timeWidth : pos+timeEntWidth])
+	return ts, relOff, nil
+}
+
+func (t *timeIndex) Write(ts int64, relOff uint32) error {
+	if t.isMaxed() {
+		return io.EOF
+	}
+	enc.PutUint64(t.mmap[t.size:t.size+timeWidth], uint64(ts))
+	enc.PutUint32(t.mmap[t.size+timeWidth:t.size+timeEntWidth], relOff)
+	t.size += timeEntWidth
+	return nil
+}
+
+// Lookup returns the relative offset to start scanning from for the first record appended at or after ts:
+// the offset right after the last entry whose time is before ts, since every record up to that entry came before ts.
+func (t *timeIndex) Lookup(ts int64) (relOff uint32, ok bool) {
+	entries := int(t.size / timeEntWidth)
+	// entries are sorted by time, find the first one that's not before ts
+	i := sort.Search(entries, func(i int) bool {
+		entTs, _, _ := t.Read(int64(i))
+		return entTs >= ts
+	})
+	if i == 0 {
+		return 0, false
+	}
+	_, relOff, _ = t.Read(int64(i - 1))
+	return relOff + 1, true
+}
+
+// Sync flushes the memory-mapped entries to the time index file
+func (t *timeIndex) Sync() error {
+	return t.mmap.Sync(gommap.MS_SYNC)
+}
+
+// truncate keeps the first entries of the time index and zeroes the rest
+func (t *timeIndex) truncate(entries uint64) {
+	t.size = entries * timeEntWidth
+	clear(t.mmap[t.size:])
+}
+
+func (t *timeIndex) isMaxed() bool {
+	return uint64(len(t.mmap)) < t.size+timeEntWidth
+}
+
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
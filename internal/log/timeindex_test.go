@@ -0,0 +1,65 @@
+package log
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "timeindex_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newTimeIndex(f, c)
+	require.NoError(t, err)
+	_, _, err = idx.Read(-1)
+	require.Error(t, err)
+	_, ok := idx.Lookup(100)
+	require.False(t, ok)
+
+	entries := []struct {
+		Ts     int64
+		RelOff uint32
+	}{
+		{Ts: 100, RelOff: 0},
+		{Ts: 200, RelOff: 4},
+		{Ts: 300, RelOff: 8},
+	}
+	for i, want := range entries {
+		require.NoError(t, idx.Write(want.Ts, want.RelOff))
+
+		ts, relOff, err := idx.Read(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Ts, ts)
+		require.Equal(t, want.RelOff, relOff)
+	}
+	_, _, err = idx.Read(int64(len(entries)))
+	require.Equal(t, io.EOF, err)
+
+	// nothing was appended before the first entry
+	_, ok = idx.Lookup(100)
+	require.False(t, ok)
+	// everything up to an entry before ts can be skipped
+	relOff, ok := idx.Lookup(250)
+	require.True(t, ok)
+	require.Equal(t, uint32(5), relOff)
+	relOff, ok = idx.Lookup(1000)
+	require.True(t, ok)
+	require.Equal(t, uint32(9), relOff)
+	require.NoError(t, idx.Close())
+
+	// time index should build its state from the existing file
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = newTimeIndex(f, c)
+	require.NoError(t, err)
+	ts, relOff, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, entries[2].Ts, ts)
+	require.Equal(t, entries[2].RelOff, relOff)
+	require.NoError(t, idx.Close())
+}
@@ -0,0 +1,423 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	api "github.com/innazh/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultTopic is the topic every cluster starts with, its log is the one under <data-dir>/log
+const defaultTopic = ""
+
+// topic is a named set of partitions of the fsm, each a DistributedLog with a Raft group of its own
+type topic struct {
+	id         uint64
+	partitions []*DistributedLog
+	config     *api.TopicConfig
+}
+
+// close closes the partitions' logs, their data stays on disk
+func (t *topic) close() error {
+	for _, log := range t.partitions {
+		if err := log.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// group is the Raft group of a topic's partition
+type group struct {
+	topic     string
+	partition uint32
+	log       *DistributedLog
+}
+
+/*
+CreateTopic creates a topic with a Raft group of its own for every partition, the config overrides the segment config of the
+servers for it. The groups start with the servers of the metadata group, and follow the servers it adds and removes after that.
+*/
+func (l *DistributedLog) CreateTopic(name string, config *api.TopicConfig) error {
+	if err := api.ValidateTopic(name); err != nil {
+		return err
+	}
+	if err := api.ValidateTopicConfig(config); err != nil {
+		return err
+	}
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	var servers []*api.Server
+	for _, srv := range future.Configuration().Servers {
+		role := api.Role_ROLE_VOTER
+		if srv.Suffrage == raft.Nonvoter {
+			role = api.Role_ROLE_READ_REPLICA
+		}
+		servers = append(servers, &api.Server{Id: string(srv.ID), RpcAddr: string(srv.Address), Role: role})
+	}
+	_, _, err := l.apply(CreateTopicRequestType, &api.CreateTopicCommand{Name: name, Config: config, Servers: servers})
+	return err
+}
+
+// DeleteTopic removes the topic along with its records. The default topic can't be deleted.
+func (l *DistributedLog) DeleteTopic(name string) error {
+	if err := api.ValidateTopic(name); err != nil {
+		return err
+	}
+	_, _, err := l.apply(DeleteTopicRequestType, &api.DeleteTopicRequest{Name: name})
+	return err
+}
+
+// ListTopics returns the topics of the local log sorted by name, without the default topic
+func (l *DistributedLog) ListTopics() []*api.Topic {
+	return l.fsm.listTopics()
+}
+
+// Partitions returns the num of partitions of the topic, or api.ErrTopicNotFound. The default topic has a single one.
+func (l *DistributedLog) Partitions(topic string) (uint32, error) {
+	return l.fsm.numPartitions(topic)
+}
+
+/*
+Partition returns the log of the topic's partition, or api.ErrTopicNotFound or api.ErrPartitionNotFound. The empty name is
+the default topic, whose only partition is this log. The consistency of the reads and the applied index of a partition are
+the ones of its own group.
+*/
+func (l *DistributedLog) Partition(topic string, partition uint32) (*DistributedLog, error) {
+	return l.fsm.partition(topic, partition)
+}
+
+// numPartitions returns the num of partitions of the topic, the empty name is the default topic
+func (f *fsm) numPartitions(name string) (uint32, error) {
+	if name == defaultTopic {
+		return 1, nil
+	}
+	f.topicsMu.RLock()
+	defer f.topicsMu.RUnlock()
+	t, ok := f.topics[name]
+	if !ok {
+		return 0, api.ErrTopicNotFound{Topic: name}
+	}
+	return uint32(len(t.partitions)), nil
+}
+
+// partition returns the log of the topic's partition, the empty name is the default topic
+func (f *fsm) partition(name string, partition uint32) (*DistributedLog, error) {
+	if name == defaultTopic {
+		if partition != 0 {
+			return nil, api.ErrPartitionNotFound{Topic: name, Partition: partition}
+		}
+		return f.dl, nil
+	}
+	f.topicsMu.RLock()
+	defer f.topicsMu.RUnlock()
+	t, ok := f.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	if partition >= uint32(len(t.partitions)) {
+		return nil, api.ErrPartitionNotFound{Topic: name, Partition: partition}
+	}
+	return t.partitions[partition], nil
+}
+
+// topicDir is the name of the topic's directory, every partition has a subdirectory of its own in it
+func topicDir(name string, id uint64) string {
+	return fmt.Sprintf("%s-%d", name, id)
+}
+
+// createTopic opens the groups of the topic's partitions, bootstrapping them with the servers given if it's one of them
+func (f *fsm) createTopic(t *api.Topic, bootstrap []raft.Server) error {
+	if err := api.ValidateTopic(t.Name); err != nil {
+		return err
+	}
+	if err := api.ValidateTopicConfig(t.Config); err != nil {
+		return err
+	}
+	f.topicsMu.Lock()
+	defer f.topicsMu.Unlock()
+	if _, ok := f.topics[t.Name]; ok {
+		return api.ErrTopicExists{Topic: t.Name}
+	}
+	topic, err := f.openTopic(t, bootstrap)
+	if err != nil {
+		return err
+	}
+	f.topics[t.Name] = topic
+	return nil
+}
+
+// openTopic opens the log of every partition of the topic, along with its Raft group
+func (f *fsm) openTopic(t *api.Topic, bootstrap []raft.Server) (*topic, error) {
+	c := f.dl.config
+	c.Raft.Bootstrap = false
+	c.Segment.InitialOffset = 0
+	if t.Config.GetMaxStoreBytes() > 0 {
+		c.Segment.MaxStoreBytes = t.Config.GetMaxStoreBytes()
+	}
+	if t.Config.GetMaxIndexBytes() > 0 {
+		c.Segment.MaxIndexBytes = t.Config.GetMaxIndexBytes()
+	}
+	topic := &topic{id: t.Id, config: t.Config}
+	for i := uint32(0); i < t.Config.NumPartitions(); i++ {
+		c.Raft.StreamLayer = f.dl.config.Raft.StreamLayer.Group(groupName(t.Name, t.Id, i))
+		dir := filepath.Join(f.dir, topicDir(t.Name, t.Id), strconv.FormatUint(uint64(i), 10))
+		log, err := newDistributedLog(dir, c, bootstrap)
+		if err != nil {
+			_ = topic.close()
+			return nil, err
+		}
+		log.wg.Add(1)
+		go log.follow(f.dl, spread(t.Name, i))
+		topic.partitions = append(topic.partitions, log)
+	}
+	return topic, nil
+}
+
+/*
+applyCreateTopic handles the create topic command, it fails with api.ErrTopicExists if the name is taken. The servers the command
+lists bootstrap the partitions' groups with the same configuration, the others wait for the groups' leaders to add them.
+*/
+func (f *fsm) applyCreateTopic(b []byte, index uint64) interface{} {
+	var req api.CreateTopicCommand
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	var bootstrap []raft.Server
+	for _, srv := range req.Servers {
+		suffrage := raft.Voter
+		if srv.Role == api.Role_ROLE_READ_REPLICA {
+			suffrage = raft.Nonvoter
+		}
+		bootstrap = append(bootstrap, raft.Server{Suffrage: suffrage, ID: raft.ServerID(srv.Id), Address: raft.ServerAddress(srv.RpcAddr)})
+	}
+	if !slices.ContainsFunc(bootstrap, func(srv raft.Server) bool { return srv.ID == f.dl.config.Raft.LocalID }) {
+		bootstrap = nil
+	}
+	if err := f.createTopic(&api.Topic{Name: req.Name, Config: req.Config, Id: index}, bootstrap); err != nil {
+		return err
+	}
+	return &api.CreateTopicResponse{}
+}
+
+// applyDeleteTopic handles the delete topic request, the partitions' groups are shut down and their logs removed from disk
+func (f *fsm) applyDeleteTopic(b []byte) interface{} {
+	var req api.DeleteTopicRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	f.topicsMu.Lock()
+	defer f.topicsMu.Unlock()
+	t, ok := f.topics[req.Name]
+	if !ok {
+		return api.ErrTopicNotFound{Topic: req.Name}
+	}
+	delete(f.topics, req.Name)
+	if err := t.close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(f.dir, topicDir(req.Name, t.id))); err != nil {
+		return err
+	}
+	return &api.DeleteTopicResponse{}
+}
+
+/*
+restoreTopics brings the topics in line with the ones of a snapshot taken once the entry at applied had been applied. The topics
+that aren't in it are gone, along with the directories of the topics whose deletion it covers. The directories of the topics
+created after it are left for Raft to apply their creation again, the state of their groups has to survive.
+*/
+func (f *fsm) restoreTopics(topics []*api.Topic, applied uint64) error {
+	f.topicsMu.Lock()
+	defer f.topicsMu.Unlock()
+
+	keep := make(map[string]bool)
+	for _, t := range topics {
+		keep[topicDir(t.Name, t.Id)] = true
+	}
+	for name, t := range f.topics {
+		if keep[topicDir(name, t.id)] {
+			continue
+		}
+		delete(f.topics, name)
+		if err := t.close(); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(filepath.Join(f.dir, topicDir(name, t.id))); err != nil {
+			return err
+		}
+	}
+	for _, t := range topics {
+		if open, ok := f.topics[t.Name]; ok && open.id == t.Id {
+			continue
+		}
+		topic, err := f.openTopic(t, nil)
+		if err != nil {
+			return err
+		}
+		f.topics[t.Name] = topic
+	}
+
+	entries, err := os.ReadDir(f.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if keep[e.Name()] {
+			continue
+		}
+		i := strings.LastIndex(e.Name(), "-")
+		if id, err := strconv.ParseUint(e.Name()[i+1:], 10, 64); i >= 0 && err == nil && id > applied {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(f.dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// topicNames returns the names of the topics sorted, without the default topic. The caller holds topicsMu.
+func (f *fsm) topicNames() []string {
+	names := make([]string, 0, len(f.topics))
+	for name := range f.topics {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (f *fsm) listTopics() []*api.Topic {
+	f.topicsMu.RLock()
+	defer f.topicsMu.RUnlock()
+	topics := make([]*api.Topic, 0, len(f.topics))
+	for _, name := range f.topicNames() {
+		t := f.topics[name]
+		topics = append(topics, &api.Topic{Name: name, Config: t.config, Id: t.id})
+	}
+	return topics
+}
+
+// groups returns the groups of every partition of the topics other than the default one
+func (f *fsm) groups() []group {
+	f.topicsMu.RLock()
+	defer f.topicsMu.RUnlock()
+	var groups []group
+	for _, name := range f.topicNames() {
+		for i, log := range f.topics[name].partitions {
+			groups = append(groups, group{topic: name, partition: uint32(i), log: log})
+		}
+	}
+	return groups
+}
+
+// closeTopics closes and forgets the topics other than the default one, their data stays on disk
+func (f *fsm) closeTopics() error {
+	f.topicsMu.Lock()
+	defer f.topicsMu.Unlock()
+	for name, t := range f.topics {
+		if err := t.close(); err != nil {
+			return err
+		}
+		delete(f.topics, name)
+	}
+	return nil
+}
+
+// writeFrame writes the bytes prefixed with their length, see snapshot
+func writeFrame(w io.Writer, b []byte) error {
+	size := make([]byte, frameLenBytes)
+	enc.PutUint32(size, uint32(len(b)))
+	if _, err := w.Write(size); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readFrame reads the bytes of the next frame, it returns io.EOF if there are no more frames
+func readFrame(r io.Reader) ([]byte, error) {
+	size, err := readFrameLen(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// frameLenBytes is the size of the length that starts a frame
+const frameLenBytes = 4
+
+// readFrameLen reads the length that starts a frame, it returns io.EOF if there are no more frames
+func readFrameLen(r io.Reader) (uint32, error) {
+	b := make([]byte, frameLenBytes)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	return enc.Uint32(b), nil
+}
+
+// frameWriter writes everything written to it as frames
+type frameWriter struct {
+	w io.Writer
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := writeFrame(w.w, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// frameReader reads the frames written by a frameWriter, up to the empty frame that ends them
+type frameReader struct {
+	r    io.Reader
+	left uint32 // bytes left in the current frame
+	done bool
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	if r.left == 0 {
+		left, err := readFrameLen(r.r)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.left = left
+		if r.left == 0 {
+			r.done = true
+			return 0, io.EOF
+		}
+	}
+	if uint32(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.left -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
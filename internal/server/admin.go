@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/innazh/proglog/api/v1"
+	"google.golang.org/grpc"
+)
+
+// Admin is what the Admin service manages the cluster with, log.DistributedLog implements it
+type Admin interface {
+	// Group returns the Admin of the topic's partition's group, or api.ErrTopicNotFound or api.ErrPartitionNotFound.
+	// The empty name is the default topic, whose only partition is replicated by the metadata group.
+	Group(topic string, partition uint32) (Admin, error)
+	GetConfiguration() ([]*api.RaftServer, error)
+	Join(id, addr string, voter bool) error
+	Leave(id string) error
+	Demote(id string) error
+	TransferLeadership(id string) error
+	Snapshot() (*api.SnapshotResponse, error)
+	Stats() map[string]string
+}
+
+// adminAction matches the constraint in our ACL policy table, only operators should be allowed to take it
+const adminAction = "admin"
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+// adminServer implements the Admin service. The calls that change the configuration are forwarded to the leader,
+// just like the produce calls, so an operator can make them on any server.
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*Config
+}
+
+func newAdminServer(config *Config) *adminServer {
+	return &adminServer{Config: config}
+}
+
+func (s *adminServer) GetConfiguration(ctx context.Context, req *api.GetConfigurationRequest) (*api.GetConfigurationResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+		return nil, err
+	}
+	group, err := s.Admin.Group(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	servers, err := group.GetConfiguration()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetConfigurationResponse{Servers: servers}, nil
+}
+
+func (s *adminServer) AddServer(ctx context.Context, req *api.AddServerRequest) (*api.AddServerResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+		return nil, err
+	}
+	if err := s.Admin.Join(req.Id, req.RpcAddr, !req.Nonvoter); err != nil {
+		if leader, ctx, ok := s.leader(ctx, err); ok {
+			return leader.AddServer(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.AddServerResponse{}, nil
+}
+
+func (s *adminServer) RemoveServer(ctx context.Context, req *api.RemoveServerRequest) (*api.RemoveServerResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+		return nil, err
+	}
+	if err := s.Admin.Leave(req.Id); err != nil {
+		if leader, ctx, ok := s.leader(ctx, err); ok {
+			return leader.RemoveServer(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.RemoveServerResponse{}, nil
+}
+
+func (s *adminServer) DemoteServer(ctx context.Context, req *api.DemoteServerRequest) (*api.DemoteServerResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+		return nil, err
+	}
+	if err := s.Admin.Demote(req.Id); err != nil {
+		if leader, ctx, ok := s.leader(ctx, err); ok {
+			return leader.DemoteServer(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.DemoteServerResponse{}, nil
+}
+
+func (s *adminServer) TransferLeadership(ctx context.Context, req *api.TransferLeadershipRequest) (*api.TransferLeadershipResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+		return nil, err
+	}
+	if err := s.Admin.TransferLeadership(req.Id); err != nil {
+		if leader, ctx, ok := s.leader(ctx, err); ok {
+			return leader.TransferLeadership(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.TransferLeadershipResponse{}, nil
+}
+
+func (s *adminServer) Snapshot(ctx context.Context, req *api.SnapshotRequest) (*api.SnapshotResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+		return nil, err
+	}
+	group, err := s.Admin.Group(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return group.Snapshot()
+}
+
+func (s *adminServer) GetStats(ctx context.Context, req *api.GetStatsRequest) (*api.GetStatsResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+		return nil, err
+	}
+	group, err := s.Admin.Group(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetStatsResponse{Stats: group.Stats()}, nil
+}
+
+// leader is grpcServer.leader for the Admin service
+func (s *adminServer) leader(ctx context.Context, err error) (api.AdminClient, context.Context, bool) {
+	conn, ctx, ok := leaderConn(ctx, s.Forwarder, err)
+	if !ok {
+		return nil, nil, false
+	}
+	return api.NewAdminClient(conn), ctx, true
+}
+
+// registerAdmin registers the Admin service if the config has something to manage the cluster with
+func registerAdmin(gsrv *grpc.Server, config *Config) {
+	if config.Admin == nil {
+		return
+	}
+	api.RegisterAdminServer(gsrv, newAdminServer(config))
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	api "github.com/innazh/proglog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// forwardedKey marks the calls a server forwarded to the leader, so they aren't forwarded again if leadership moved on in the meantime
+const forwardedKey = "proglog-forwarded"
+
+/*
+Forwarder sends the produce and admin calls a follower gets on to the Raft leader, so clients can make them on any server.
+It keeps a connection to every leader it has forwarded to. Forwarded calls are made with the identity of the dial options' credentials,
+so it has to be allowed to produce and administer the cluster as well.
+*/
+type Forwarder struct {
+	opts []grpc.DialOption
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// NewForwarder creates a forwarder that connects to the leaders with the given dial options, e.g. the peer TLS credentials
+func NewForwarder(opts ...grpc.DialOption) *Forwarder {
+	return &Forwarder{
+		opts:  opts,
+		conns: make(map[string]*grpc.ClientConn),
+	}
+}
+
+// conn returns the connection to the server at addr, connecting to it the first time
+func (f *Forwarder) conn(addr string) (*grpc.ClientConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	conn, ok := f.conns[addr]
+	if !ok {
+		var err error
+		if conn, err = grpc.NewClient(addr, f.opts...); err != nil {
+			return nil, err
+		}
+		f.conns[addr] = conn
+	}
+	return conn, nil
+}
+
+// Close closes the connections to the leaders
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var err error
+	for addr, conn := range f.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(f.conns, addr)
+	}
+	return err
+}
+
+// leader returns a client for the leader and the context to forward the call with, if err says we aren't the leader and the call
+// can be forwarded: forwarding is enabled, there's a leader and the call wasn't forwarded to us already.
+func (s *grpcServer) leader(ctx context.Context, err error) (api.LogClient, context.Context, bool) {
+	conn, ctx, ok := leaderConn(ctx, s.Forwarder, err)
+	if !ok {
+		return nil, nil, false
+	}
+	return api.NewLogClient(conn), ctx, true
+}
+
+// leaderConn is leader for any of the services, it returns the connection to the leader instead of a client
+func leaderConn(ctx context.Context, f *Forwarder, err error) (*grpc.ClientConn, context.Context, bool) {
+	notLeader, ok := err.(api.ErrNotLeader)
+	if !ok || f == nil || notLeader.LeaderAddr == "" {
+		return nil, nil, false
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(forwardedKey)) > 0 {
+		return nil, nil, false
+	}
+	conn, err := f.conn(notLeader.LeaderAddr)
+	if err != nil {
+		return nil, nil, false
+	}
+	return conn, metadata.AppendToOutgoingContext(ctx, forwardedKey, "true"), true
+}
+
+// relay forwards the stream to the leader and sends everything it gets back on to our client
+func relay(ctx context.Context, leader api.LogClient, req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	forwarded, err := leader.ConsumeStream(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := forwarded.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
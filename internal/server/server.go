@@ -1,7 +1,10 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	api "github.com/innazh/proglog/api/v1"
@@ -33,7 +36,39 @@ Now we can use an in-memory Log and use it for testing, for example. While still
 */
 type CommitLog interface { //internal/log & internal/segment will already have this interface
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) (first, last uint64, err error)
 	Read(uint64) (*api.Record, error)
+	// ReadBatch reads consecutive records from the offset on, up to the num of records and bytes given (zero for no limit).
+	// Unlike Read, it skips the records compaction removed, so the records are consumed from it.
+	ReadBatch(off uint64, maxRecords int, maxBytes uint64) ([]*api.Record, error)
+	OffsetForTime(int64) (uint64, error)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	NextOffset() (uint64, error)
+	// VerifyRead checks that the log is up to date enough to be read from with the consistency, see log.DistributedLog.VerifyRead
+	VerifyRead(consistency api.ReadConsistency, maxLag uint64, maxStaleness time.Duration) error
+	// WaitApplied waits until the log has applied the write at the index, see IndexedLog
+	WaitApplied(ctx context.Context, index uint64) error
+	// Wait blocks until there's a record at the offset or after it, or the context is done
+	Wait(ctx context.Context, off uint64) error
+}
+
+// IndexedLog is a CommitLog that tells which write its appends were committed with, see log.DistributedLog.AppendIndexed.
+// The index is handed out to clients as the commit index, for the logs that aren't one it's zero.
+type IndexedLog interface {
+	AppendIndexed(*api.Record) (offset, index uint64, err error)
+	AppendBatchIndexed([]*api.Record) (first, last, index uint64, err error)
+}
+
+// IdempotentLog is a CommitLog that deduplicates the records of idempotent producers, see log.DistributedLog.AppendIdempotent.
+// The produce calls with a producer id fail on the logs that aren't one.
+type IdempotentLog interface {
+	AppendIdempotent(producerID, sequence uint64, records []*api.Record) (first, last, index uint64, err error)
+}
+
+// Producers hands out the ids of idempotent producers, see log.DistributedLog.InitProducer
+type Producers interface {
+	InitProducer() (uint64, error)
 }
 
 // we depend on the interface for Authorizer so we can switch out the authorization implementation, justl ike for the CommitLog; Dependency Inversion with Interfaces
@@ -45,10 +80,27 @@ type GetServerer interface {
 	GetServers() ([]*api.Server, error)
 }
 
+// Topics manages the named topics, every partition of them is a CommitLog of its own. See log.DistributedLog.
+type Topics interface {
+	CreateTopic(name string, config *api.TopicConfig) error
+	DeleteTopic(name string) error
+	ListTopics() []*api.Topic
+	// Partitions returns the num of partitions of the topic, or api.ErrTopicNotFound
+	Partitions(topic string) (uint32, error)
+	// Partition returns the commit log of the topic's partition, or api.ErrTopicNotFound or api.ErrPartitionNotFound
+	Partition(topic string, partition uint32) (CommitLog, error)
+}
+
 type Config struct {
-	CommitLog   CommitLog
+	CommitLog   CommitLog // the default topic, which has a single partition
+	Topics      Topics    // nil serves the default topic only
+	Producers   Producers // nil doesn't hand out producer ids
 	Authorizer  Authorizer
 	GetServerer GetServerer
+	// Forwarder forwards the produce calls to the leader when this server isn't it, nil returns api.ErrNotLeader to the client instead
+	Forwarder *Forwarder
+	// Admin serves the Admin service, it isn't registered if nil. Its calls require the admin action.
+	Admin Admin
 }
 
 const (
@@ -69,6 +121,7 @@ var _ api.LogServer = (*grpcServer)(nil)
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	produced atomic.Uint32 // spreads the records without a key or partition over the partitions
 }
 
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
@@ -115,6 +168,7 @@ func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server,
 		return nil, err
 	}
 	api.RegisterLogServer(gsrv, srv)
+	registerAdmin(gsrv, config)
 	return gsrv, nil
 }
 
@@ -122,12 +176,120 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, produceAction); err != nil {
 		return nil, err
 	}
+	if err := api.ValidateRecord(req.Record); err != nil {
+		return nil, err
+	}
+
+	partition, err := s.partition(req.Topic, req.Partition, req.Record.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	commitLog, err := s.commitLog(req.Topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	var offset, index uint64
+	if req.ProducerId != 0 {
+		offset, _, index, err = appendIdempotent(commitLog, req.ProducerId, req.Sequence, []*api.Record{req.Record})
+	} else {
+		offset, index, err = appendIndexed(commitLog, req.Record)
+	}
+	if err != nil {
+		if leader, ctx, ok := s.leader(ctx, err); ok {
+			// pin the partition we picked, so the leader doesn't pick another one for records without a key
+			req.Partition = &partition
+			return leader.Produce(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.ProduceResponse{Offset: offset, CommitIndex: index, Partition: partition}, nil
+}
+
+// ProduceBatch appends all the records or none of them, and returns the range of offsets they got
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, produceAction); err != nil {
+		return nil, err
+	}
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "batch has no records")
+	}
 
-	offset, err := s.CommitLog.Append(req.Record)
+	keys := make([][]byte, len(req.Records))
+	for i, record := range req.Records {
+		if err := api.ValidateRecord(record); err != nil {
+			return nil, err
+		}
+		keys[i] = record.GetKey()
+	}
+	partition, err := s.partition(req.Topic, req.Partition, keys...)
+	if err != nil {
+		return nil, err
+	}
+	commitLog, err := s.commitLog(req.Topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	var first, last, index uint64
+	if req.ProducerId != 0 {
+		first, last, index, err = appendIdempotent(commitLog, req.ProducerId, req.Sequence, req.Records)
+	} else {
+		first, last, index, err = appendBatchIndexed(commitLog, req.Records)
+	}
 	if err != nil {
+		if leader, ctx, ok := s.leader(ctx, err); ok {
+			// pin the partition we picked, so the leader doesn't pick another one for records without a key
+			req.Partition = &partition
+			return leader.ProduceBatch(ctx, req)
+		}
 		return nil, err
 	}
-	return &api.ProduceResponse{Offset: offset}, nil
+	return &api.ProduceBatchResponse{FirstOffset: first, LastOffset: last, CommitIndex: index, Partition: partition}, nil
+}
+
+// appendIndexed appends the record, along with the index it was committed with if the commit log tells it
+func appendIndexed(commitLog CommitLog, record *api.Record) (offset, index uint64, err error) {
+	if indexed, ok := commitLog.(IndexedLog); ok {
+		return indexed.AppendIndexed(record)
+	}
+	offset, err = commitLog.Append(record)
+	return offset, 0, err
+}
+
+// appendBatchIndexed appends the records, along with the index they were committed with if the commit log tells it
+func appendBatchIndexed(commitLog CommitLog, records []*api.Record) (first, last, index uint64, err error) {
+	if indexed, ok := commitLog.(IndexedLog); ok {
+		return indexed.AppendBatchIndexed(records)
+	}
+	first, last, err = commitLog.AppendBatch(records)
+	return first, last, 0, err
+}
+
+// appendIdempotent appends the records of an idempotent producer, if the commit log deduplicates them
+func appendIdempotent(commitLog CommitLog, producerID, sequence uint64, records []*api.Record) (first, last, index uint64, err error) {
+	idempotent, ok := commitLog.(IdempotentLog)
+	if !ok {
+		return 0, 0, 0, status.Error(codes.Unimplemented, "idempotent producers aren't supported")
+	}
+	return idempotent.AppendIdempotent(producerID, sequence, records)
+}
+
+// InitProducer hands out the id the producer deduplicates its produce calls with
+func (s *grpcServer) InitProducer(ctx context.Context, req *api.InitProducerRequest) (*api.InitProducerResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, produceAction); err != nil {
+		return nil, err
+	}
+	if s.Producers == nil {
+		return nil, status.Error(codes.Unimplemented, "idempotent producers aren't supported")
+	}
+
+	id, err := s.Producers.InitProducer()
+	if err != nil {
+		if leader, ctx, ok := s.leader(ctx, err); ok {
+			return leader.InitProducer(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.InitProducerResponse{ProducerId: id}, nil
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
@@ -135,13 +297,135 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 		return nil, err
 	}
 
-	record, err := s.CommitLog.Read(req.Offset)
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyRead(commitLog, req); err != nil {
+		if leader, ctx, ok := s.leader(ctx, err); ok {
+			return leader.Consume(ctx, req)
+		}
+		return nil, err
+	}
+	if err := waitApplied(ctx, commitLog, req); err != nil {
+		return nil, err
+	}
+
+	offset, err := startOffset(commitLog, req)
 	if err != nil {
 		return nil, err
 	}
-	return &api.ConsumeResponse{Record: record}, nil
+
+	if req.MaxRecords > 0 || req.MaxBytes > 0 {
+		maxBytes := req.MaxBytes
+		if maxBytes == 0 {
+			maxBytes = defaultConsumeMaxBytes
+		}
+		records, err := commitLog.ReadBatch(offset, int(req.MaxRecords), maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ConsumeResponse{Records: records}, nil
+	}
+
+	// consumers go on from the record's own offset, it's after the one asked for if that one was compacted away
+	records, err := commitLog.ReadBatch(offset, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeResponse{Record: records[0]}, nil
+}
+
+// commitLog returns the commit log of the topic's partition, the empty name is the default topic
+func (s *grpcServer) commitLog(topic string, partition uint32) (CommitLog, error) {
+	if topic == "" {
+		if partition != 0 {
+			return nil, api.ErrPartitionNotFound{Topic: topic, Partition: partition}
+		}
+		return s.CommitLog, nil
+	}
+	if s.Topics == nil {
+		return nil, api.ErrTopicNotFound{Topic: topic}
+	}
+	return s.Topics.Partition(topic, partition)
+}
+
+/*
+partition returns the partition of the topic a produce call appends to: the one it asks for if it does, else the one the keys
+hash to, so the records of a key are kept in order. The records without either are spread over the partitions round robin.
+*/
+func (s *grpcServer) partition(topic string, partition *uint32, keys ...[]byte) (uint32, error) {
+	if partition != nil {
+		return *partition, nil
+	}
+	if topic == "" {
+		return 0, nil
+	}
+	if s.Topics == nil {
+		return 0, api.ErrTopicNotFound{Topic: topic}
+	}
+	partitions, err := s.Topics.Partitions(topic)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if len(key) == 0 {
+			continue
+		}
+		p := api.KeyPartition(key, partitions)
+		if partition != nil && p != *partition {
+			return 0, status.Error(codes.InvalidArgument, "the keys of the batch hash to different partitions, send them in a batch per partition")
+		}
+		partition = &p
+	}
+	if partition != nil {
+		return *partition, nil
+	}
+	return s.produced.Add(1) % partitions, nil
 }
 
+// verifyRead checks that the log can be read from with the consistency the request asks for
+func verifyRead(commitLog CommitLog, req *api.ConsumeRequest) error {
+	if _, ok := api.ReadConsistency_name[int32(req.Consistency)]; !ok {
+		return status.Errorf(codes.InvalidArgument, "unknown read consistency: %v", req.Consistency)
+	}
+	return commitLog.VerifyRead(req.Consistency, req.MaxLag, time.Duration(req.MaxStaleness))
+}
+
+// maxApplyWait bounds how long a read waits for the server to apply the index it asks for
+const maxApplyWait = 10 * time.Second
+
+// waitApplied waits until the log has applied the index the request asks for, so it reads every write that index was handed out for
+func waitApplied(ctx context.Context, commitLog CommitLog, req *api.ConsumeRequest) error {
+	if req.MinAppliedIndex == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, maxApplyWait)
+	defer cancel()
+	if err := commitLog.WaitApplied(ctx, req.MinAppliedIndex); err != nil {
+		return status.Errorf(status.FromContextError(err).Code(), "gave up waiting to apply index %d: %v", req.MinAppliedIndex, err)
+	}
+	return nil
+}
+
+// startOffset resolves the offset the request starts reading from according to its start position
+func startOffset(commitLog CommitLog, req *api.ConsumeRequest) (uint64, error) {
+	switch req.Start {
+	case api.StartPosition_START_POSITION_OFFSET:
+		return req.Offset, nil
+	case api.StartPosition_START_POSITION_EARLIEST:
+		return commitLog.LowestOffset()
+	case api.StartPosition_START_POSITION_LATEST:
+		return commitLog.NextOffset()
+	case api.StartPosition_START_POSITION_TIMESTAMP:
+		return commitLog.OffsetForTime(req.StartTime)
+	}
+	return 0, status.Errorf(codes.InvalidArgument, "unknown start position: %v", req.Start)
+}
+
+// defaultConsumeMaxBytes bounds the batches of records consumers ask for without a size limit, well below gRPC's max message size
+const defaultConsumeMaxBytes = 1 << 20
+
 /*
 ProduceStream implements bidirectional streaming RPC.
 It's bidirectional so that the client can get a response back on each one of its requests to add log to the server.
@@ -168,25 +452,190 @@ This allows the client to request where the server needs to start reading and th
 The server will stream all newly added records, until the stream is closed.
 */
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	ctx := stream.Context()
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return err
+	}
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	if err := verifyRead(commitLog, req); err != nil {
+		if leader, ctx, ok := s.leader(ctx, err); ok {
+			return relay(ctx, leader, req, stream)
+		}
+		return err
+	}
+	if err := waitApplied(ctx, commitLog, req); err != nil {
+		return err
+	}
+	// the consistency is checked and the start position resolved once, the stream carries on from there
+	offset, err := startOffset(commitLog, req)
+	if err != nil {
+		return err
+	}
+	req.Offset, req.Start = offset, api.StartPosition_START_POSITION_OFFSET
+	req.Consistency, req.MinAppliedIndex = api.ReadConsistency_READ_CONSISTENCY_ANY, 0
+	skipped := false // whether the filter dropped records since the last response
 	for {
-		select {
-		case <-stream.Context().Done(): //Allows the server to stop streaming if the client cancels the request or if a context timeout occurs.
+		if ctx.Err() != nil { //Allows the server to stop streaming if the client cancels the request or if a context timeout occurs.
 			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
+		}
+		res, err := s.Consume(ctx, req)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			// we've caught up with the log, let the client know how far it got if it hasn't heard since the filter dropped records
+			if skipped {
+				if err = stream.Send(&api.ConsumeResponse{NextOffset: req.Offset}); err != nil {
+					return err
+				}
+				skipped = false
 			}
-			if err = stream.Send(res); err != nil {
-				return err
+			// block until the next record is appended instead of polling for it
+			if commitLog.Wait(ctx, req.Offset) != nil {
+				return nil
 			}
-			req.Offset++
+			// if there's still nothing to read, the offset was truncated away rather than not written yet
+			res, err = s.Consume(ctx, req)
+		}
+		if err != nil {
+			return err
+		}
+		// compaction can leave gaps, so carry on after the last record we actually got
+		if len(res.Records) > 0 {
+			req.Offset = res.Records[len(res.Records)-1].Offset + 1
+		} else {
+			req.Offset = res.Record.Offset + 1
+		}
+		res.NextOffset = req.Offset
+		if !filterResponse(req.Filter, res) {
+			skipped = true
+			continue
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+		skipped = false
+	}
+}
+
+// filterResponse drops the records that don't match the filter from the response, and tells whether any are left
+func filterResponse(filter *api.RecordFilter, res *api.ConsumeResponse) bool {
+	if filter == nil {
+		return true
+	}
+	if res.Record != nil {
+		return matches(filter, res.Record)
+	}
+	records := res.Records[:0]
+	for _, record := range res.Records {
+		if matches(filter, record) {
+			records = append(records, record)
 		}
 	}
+	res.Records = records
+	return len(records) > 0
+}
+
+// matches tells whether the record passes every condition of the filter
+func matches(filter *api.RecordFilter, record *api.Record) bool {
+	if len(filter.Types) > 0 && !slices.Contains(filter.Types, record.Type) {
+		return false
+	}
+	for name, want := range filter.Headers {
+		if value, ok := record.Headers[name]; !ok || !bytes.Equal(value, want) {
+			return false
+		}
+	}
+	return bytes.HasPrefix(record.Value, filter.ValuePrefix)
+}
+
+// GetOffsets returns the bounds of the log, e.g. for consumers to find out how far behind they are
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	lowest, err := commitLog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := commitLog.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	next, err := commitLog.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetOffsetsResponse{LowestOffset: lowest, HighestOffset: highest, NextOffset: next}, nil
+}
+
+// GetOffsetForTime returns the offset of the first record appended at or after the requested time, so consumers can start reading from a point in time
+func (s *grpcServer) GetOffsetForTime(ctx context.Context, req *api.GetOffsetForTimeRequest) (*api.GetOffsetForTimeResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := commitLog.OffsetForTime(req.Time)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetOffsetForTimeResponse{Offset: offset}, nil
+}
+
+// CreateTopic creates a topic on the leader, it's forwarded there if this server isn't it
+func (s *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics aren't supported")
+	}
+
+	if err := s.Topics.CreateTopic(req.Name, req.Config); err != nil {
+		if leader, ctx, ok := s.leader(ctx, err); ok {
+			return leader.CreateTopic(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.CreateTopicResponse{}, nil
+}
+
+// DeleteTopic removes the topic with all its records on every server
+func (s *grpcServer) DeleteTopic(ctx context.Context, req *api.DeleteTopicRequest) (*api.DeleteTopicResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics aren't supported")
+	}
+
+	if err := s.Topics.DeleteTopic(req.Name); err != nil {
+		if leader, ctx, ok := s.leader(ctx, err); ok {
+			return leader.DeleteTopic(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.DeleteTopicResponse{}, nil
+}
+
+// ListTopics returns the topics this server knows of
+func (s *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (*api.ListTopicsResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return &api.ListTopicsResponse{}, nil
+	}
+	return &api.ListTopicsResponse{Topics: s.Topics.ListTopics()}, nil
 }
 
 func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
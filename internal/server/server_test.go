@@ -3,8 +3,10 @@ package server
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -48,6 +50,14 @@ func TestServer(t *testing.T) {
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
 		"consume past log boundary fails":                     testConsumePastBoundary,
 		"unauthorized fails":                                  testUnauthorized,
+		"consume corrupt record fails":                        testConsumeCorruptRecord,
+		"get offset for time succeeds":                        testGetOffsetForTime,
+		"produce batch succeeds":                              testProduceBatch,
+		"consume batches succeeds":                            testConsumeBatches,
+		"consume from start positions succeeds":               testConsumeStartPositions,
+		"consume stream with a filter succeeds":               testConsumeStreamFilter,
+		"produce/consume headers succeeds":                    testProduceConsumeHeaders,
+		"idempotent produce without support fails":            testIdempotentUnsupported,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rc, nc, config, teardown := setupTest(t, nil)
@@ -205,6 +215,59 @@ func testProduceConsume(t *testing.T, client, _ api.LogClient, config *Config) {
 	require.Equal(t, want.Offset, consume.Record.Offset)
 }
 
+func testProduceConsumeHeaders(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	want := &api.Record{
+		Value:     []byte("hello world"),
+		Key:       []byte("greeting"),
+		Headers:   map[string][]byte{"trace-id": []byte("abc123"), "content-type": []byte("text/plain")},
+		Timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano(),
+	}
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: want})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, want.Key, consume.Record.Key)
+	require.Equal(t, want.Headers, consume.Record.Headers)
+	require.Equal(t, want.Timestamp, consume.Record.Timestamp)
+	require.NotEqual(t, want.Timestamp, consume.Record.AppendTime)
+
+	// the headers are bounded in num and in size, for single records and batches alike
+	tooMany := make(map[string][]byte)
+	for i := 0; i <= api.MaxHeaders; i++ {
+		tooMany[fmt.Sprintf("header-%d", i)] = nil
+	}
+	for _, headers := range []map[string][]byte{
+		tooMany,
+		{"big": make([]byte, api.MaxHeadersBytes)},
+		{"": []byte("no name")},
+	} {
+		record := &api.Record{Value: []byte("hello world"), Headers: headers}
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: record})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+		_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: []*api.Record{want, record}})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+
+	// and there has to be a record in the first place
+	_, err = client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testIdempotentUnsupported(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// the log the server is set up with doesn't deduplicate, and there's nothing to hand out producer ids
+	_, err := client.InitProducer(ctx, &api.InitProducerRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	record := &api.Record{Value: []byte("hello world")}
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: record, ProducerId: 1})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: []*api.Record{record}, ProducerId: 1})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
 func testConsumePastBoundary(
 	t *testing.T,
 	client, _ api.LogClient,
@@ -279,11 +342,26 @@ func testProduceConsumeStream(
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
-			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
-			})
+			require.Equal(t, record.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+			require.NotZero(t, res.Record.AppendTime)
 		}
+
+		// the stream has caught up, so it waits for the next record to be produced
+		recv := make(chan *api.ConsumeResponse)
+		go func() {
+			res, err := stream.Recv()
+			if err == nil {
+				recv <- res
+			}
+			close(recv)
+		}()
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("third message")}})
+		require.NoError(t, err)
+		res, ok := <-recv
+		require.True(t, ok)
+		require.Equal(t, []byte("third message"), res.Record.Value)
+		require.Equal(t, uint64(len(records)), res.Record.Offset)
 	}
 }
 
@@ -319,3 +397,463 @@ func testUnauthorized(
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
 }
+
+func testConsumeCorruptRecord(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{
+			Value: []byte("hello world"),
+		},
+	})
+	require.NoError(t, err)
+
+	// the first consume flushes the record to disk
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+
+	clog := config.CommitLog.(*log.Log)
+	storeFile := filepath.Join(clog.Dir, "0.store")
+	b, err := os.ReadFile(storeFile)
+	require.NoError(t, err)
+	b[len(b)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(storeFile, b, 0600))
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.Nil(t, consume)
+	require.Equal(t, codes.DataLoss, status.Code(err))
+}
+
+func testGetOffsetForTime(
+	t *testing.T,
+	client, nobody api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	before := time.Now().UnixNano()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("hello world"),
+			},
+		})
+		require.NoError(t, err)
+	}
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+
+	res, err := client.GetOffsetForTime(ctx, &api.GetOffsetForTimeRequest{Time: before})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	res, err = client.GetOffsetForTime(ctx, &api.GetOffsetForTimeRequest{Time: consume.Record.AppendTime})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+
+	res, err = client.GetOffsetForTime(ctx, &api.GetOffsetForTimeRequest{Time: time.Now().UnixNano()})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Offset)
+
+	_, err = nobody.GetOffsetForTime(ctx, &api.GetOffsetForTimeRequest{Time: before})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testProduceBatch(
+	t *testing.T,
+	client, nobody api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}
+	res, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.FirstOffset)
+	require.Equal(t, uint64(3), res.LastOffset)
+	for i, record := range records {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: res.FirstOffset + uint64(i)})
+		require.NoError(t, err)
+		require.Equal(t, record.Value, consume.Record.Value)
+	}
+
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = nobody.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testConsumeBatches(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	var records []*api.Record
+	for i := 0; i < 10; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 2, MaxRecords: 4})
+	require.NoError(t, err)
+	require.Nil(t, res.Record)
+	require.Len(t, res.Records, 4)
+	for i, record := range res.Records {
+		require.Equal(t, uint64(2+i), record.Offset)
+		require.Equal(t, records[2+i].Value, record.Value)
+	}
+
+	// a batch holds at least one record, however small max bytes is
+	res, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0, MaxBytes: 1})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 10, MaxRecords: 4})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0, MaxRecords: 4})
+	require.NoError(t, err)
+	var offsets []uint64
+	for _, want := range []int{4, 4, 2} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Len(t, res.Records, want)
+		for _, record := range res.Records {
+			offsets = append(offsets, record.Offset)
+		}
+	}
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, offsets)
+}
+
+func testConsumeStartPositions(
+	t *testing.T,
+	client, nobody api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.LowestOffset)
+	require.Equal(t, uint64(0), offsets.NextOffset)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	offsets, err = client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.LowestOffset)
+	require.Equal(t, uint64(2), offsets.HighestOffset)
+	require.Equal(t, uint64(3), offsets.NextOffset)
+
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 2, Start: api.StartPosition_START_POSITION_EARLIEST})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+
+	res, err = client.Consume(ctx, &api.ConsumeRequest{Start: api.StartPosition_START_POSITION_TIMESTAMP, StartTime: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+
+	// tailing from the latest position only gets the records produced after the stream started.
+	// The stream starts asynchronously, so keep producing until it gets one.
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Start: api.StartPosition_START_POSITION_LATEST})
+	require.NoError(t, err)
+	recv := make(chan *api.ConsumeResponse, 1)
+	go func() {
+		res, err := stream.Recv()
+		if err == nil {
+			recv <- res
+		}
+		close(recv)
+	}()
+	for got := false; !got; {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("latest")}})
+		require.NoError(t, err)
+		select {
+		case res, ok := <-recv:
+			require.True(t, ok)
+			require.Equal(t, []byte("latest"), res.Record.Value)
+			got = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Start: api.StartPosition(42)})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Consistency: api.ReadConsistency(42)})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = nobody.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testConsumeStreamFilter(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	records := []*api.Record{
+		{Value: []byte("keep 0")},
+		{Value: []byte("drop 1"), Type: 1},
+		{Value: []byte("drop 2")},
+	}
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Filter: &api.RecordFilter{ValuePrefix: []byte("keep")},
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+	require.Equal(t, uint64(1), res.NextOffset)
+
+	// the stream caught up after skipping the records that don't match
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Nil(t, res.Record)
+	require.Empty(t, res.Records)
+	require.Equal(t, uint64(3), res.NextOffset)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("keep 3")}})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Record.Offset)
+	require.Equal(t, uint64(4), res.NextOffset)
+
+	// batches only keep the records that match
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{
+		MaxRecords: 10,
+		Filter:     &api.RecordFilter{Types: []uint32{1}},
+	})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, uint64(1), res.Records[0].Offset)
+	require.Equal(t, uint64(4), res.NextOffset)
+
+	// the records have to have every header of the filter, with the same value, an empty one included
+	records = []*api.Record{
+		{Value: []byte("order 4"), Headers: map[string][]byte{"tenant": []byte("acme"), "region": []byte("eu"), "trace": nil}},
+		{Value: []byte("order 5"), Headers: map[string][]byte{"tenant": []byte("acme"), "region": []byte("eu")}},
+		{Value: []byte("order 6"), Headers: map[string][]byte{"tenant": []byte("acme"), "region": []byte("us"), "trace": nil}},
+		{Value: []byte("order 7")},
+	}
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:     4,
+		MaxRecords: 10,
+		Filter: &api.RecordFilter{
+			Headers: map[string][]byte{"region": []byte("eu"), "trace": nil},
+		},
+	})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, uint64(4), res.Records[0].Offset)
+	require.Equal(t, uint64(8), res.NextOffset)
+}
+
+func TestTopics(t *testing.T) {
+	topics := &testTopics{dir: t.TempDir(), logs: map[string][]*log.Log{}}
+	client, nobody, _, teardown := setupTest(t, func(c *Config) {
+		c.Topics = topics
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "orders"})
+	require.NoError(t, err)
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "orders"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = nobody.CreateTopic(ctx, &api.CreateTopicRequest{Name: "payments"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	listed, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Len(t, listed.Topics, 1)
+	require.Equal(t, "orders", listed.Topics[0].Name)
+
+	// the topic and the default topic are independent logs
+	produced, err := client.Produce(ctx, &api.ProduceRequest{Topic: "orders", Record: &api.Record{Value: []byte("order")}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produced.Offset)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+	consumed, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), consumed.Record.Value)
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offsets.NextOffset)
+
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Name: "orders"})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "orders", Record: &api.Record{Value: []byte("order")}})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.NoError(t, err)
+}
+
+func TestPartitions(t *testing.T) {
+	topics := &testTopics{dir: t.TempDir(), logs: map[string][]*log.Log{}}
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Topics = topics
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	const partitions = 4
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "orders", Config: &api.TopicConfig{Partitions: partitions}})
+	require.NoError(t, err)
+
+	// the records of a key all go to the partition it hashes to, in order
+	key := []byte("customer-1")
+	want := api.KeyPartition(key, partitions)
+	for i := 0; i < 3; i++ {
+		produced, err := client.Produce(ctx, &api.ProduceRequest{Topic: "orders", Record: &api.Record{Key: key, Value: []byte{byte(i)}}})
+		require.NoError(t, err)
+		require.Equal(t, want, produced.Partition)
+		require.Equal(t, uint64(i), produced.Offset)
+	}
+	consumed, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Partition: want, Offset: 2})
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, consumed.Record.Value)
+
+	// the partition asked for wins over the key
+	explicit := (want + 1) % partitions
+	produced, err := client.Produce(ctx, &api.ProduceRequest{Topic: "orders", Partition: &explicit, Record: &api.Record{Key: key}})
+	require.NoError(t, err)
+	require.Equal(t, explicit, produced.Partition)
+
+	// the records without a key are spread over every partition
+	seen := make(map[uint32]bool)
+	for i := 0; i < partitions; i++ {
+		produced, err := client.Produce(ctx, &api.ProduceRequest{Topic: "orders", Record: &api.Record{Value: []byte("any")}})
+		require.NoError(t, err)
+		seen[produced.Partition] = true
+	}
+	require.Len(t, seen, partitions)
+
+	// a batch goes to a single partition
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{Topic: "orders", Partition: want})
+	require.NoError(t, err)
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Topic: "orders", Records: []*api.Record{
+		{Key: key, Value: []byte{3}},
+		{Value: []byte("unkeyed")},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, want, batch.Partition)
+	require.Equal(t, offsets.NextOffset, batch.FirstOffset)
+	var other []byte
+	for i := 0; other == nil; i++ {
+		if k := []byte(fmt.Sprintf("customer-%d", i)); api.KeyPartition(k, partitions) != want {
+			other = k
+		}
+	}
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Topic: "orders", Records: []*api.Record{{Key: key}, {Key: other}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	offsets, err = client.GetOffsets(ctx, &api.GetOffsetsRequest{Topic: "orders", Partition: want})
+	require.NoError(t, err)
+	require.Equal(t, batch.LastOffset+1, offsets.NextOffset)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Partition: partitions})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Partition: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// testTopics keeps a plain log for every partition
+type testTopics struct {
+	dir  string
+	logs map[string][]*log.Log
+}
+
+func (t *testTopics) CreateTopic(name string, config *api.TopicConfig) error {
+	if _, ok := t.logs[name]; ok {
+		return api.ErrTopicExists{Topic: name}
+	}
+	for i := uint32(0); i < config.NumPartitions(); i++ {
+		dir := filepath.Join(t.dir, name, fmt.Sprint(i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		l, err := log.NewLog(dir, log.Config{})
+		if err != nil {
+			return err
+		}
+		t.logs[name] = append(t.logs[name], l)
+	}
+	return nil
+}
+
+func (t *testTopics) DeleteTopic(name string) error {
+	logs, ok := t.logs[name]
+	if !ok {
+		return api.ErrTopicNotFound{Topic: name}
+	}
+	delete(t.logs, name)
+	for _, l := range logs {
+		if err := l.Remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *testTopics) ListTopics() []*api.Topic {
+	var topics []*api.Topic
+	for name, logs := range t.logs {
+		topics = append(topics, &api.Topic{Name: name, Config: &api.TopicConfig{Partitions: uint32(len(logs))}})
+	}
+	return topics
+}
+
+func (t *testTopics) Partitions(topic string) (uint32, error) {
+	logs, ok := t.logs[topic]
+	if !ok {
+		return 0, api.ErrTopicNotFound{Topic: topic}
+	}
+	return uint32(len(logs)), nil
+}
+
+func (t *testTopics) Partition(topic string, partition uint32) (CommitLog, error) {
+	logs, ok := t.logs[topic]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: topic}
+	}
+	if partition >= uint32(len(logs)) {
+		return nil, api.ErrPartitionNotFound{Topic: topic, Partition: partition}
+	}
+	return logs[partition], nil
+}